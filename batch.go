@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Batches. POST /kvs/batch takes many gets, puts and deletes with one
+// causal context. The coordinator groups them by the shard that owns each
+// key and sends every shard its whole group in one request, all shards in
+// parallel. The node that gets a group runs each operation through the
+// same code a single request would go through, one after another in the
+// order the client gave them.
+const maxBatch = 1000
+
+// one operation in a batch
+type BatchOp struct {
+	//"get", "put" or "delete"
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"val,omitempty"`
+	//same conditions a single write takes
+	Condition
+	TTL int `json:"ttl,omitempty"`
+}
+
+// what a client sends to /kvs/batch, and what a shard gets sent
+type BatchRequest struct {
+	Ops         []BatchOp     `json:"ops"`
+	Vector      CausalContext `json:"causal-metadata"`
+	Consistency string        `json:"consistency,omitempty"`
+}
+
+// how one operation went
+type BatchResult struct {
+	Op     string          `json:"op"`
+	Key    string          `json:"key"`
+	Status int             `json:"status"`
+	Value  json.RawMessage `json:"val,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	//not sent back to the client, merged into the batch's metadata
+	Vector CausalContext `json:"causal-metadata,omitempty"`
+}
+
+// what runs each kind of operation, same as for a single request
+var batchOps = map[string]func(context.Context, string, DataRequest) dataResult{
+	"get":    get_key,
+	"put":    put_key,
+	"delete": delete_key,
+}
+
+// runs one operation on this node
+func run_op(rctx context.Context, op BatchOp, vector CausalContext, consistency string) BatchResult {
+	answered := batchOps[op.Op](rctx, op.Key, DataRequest{
+		Value:       op.Value,
+		Vector:      vector,
+		Consistency: consistency,
+		Condition:   op.Condition,
+		TTL:         op.TTL,
+	})
+
+	res := BatchResult{Op: op.Op, Key: op.Key, Status: answered.status}
+	var answer struct {
+		Value  json.RawMessage `json:"val"`
+		Error  string          `json:"error"`
+		Vector CausalContext   `json:"causal-metadata"`
+	}
+	if json.Unmarshal(answered.encoded(), &answer) == nil {
+		res.Value = answer.Value
+		res.Error = answer.Error
+		res.Vector = answer.Vector
+	}
+	return res
+}
+
+// runs a shard's group in order
+func run_group(rctx context.Context, ops []BatchOp, vector CausalContext, consistency string) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = run_op(rctx, op, vector, consistency)
+	}
+	return results
+}
+
+// sends a group to the shard that owns it, trying its replicas in turn
+func send_group(upstream NodeShards, req BatchRequest) []BatchResult {
+	client := http.Client{
+		Timeout: quorumTimeout + causalTimeout,
+	}
+	body, _ := json.Marshal(req)
+	for _, address := range live_first(upstream.Node) {
+		r, _ := http.NewRequest("PUT", "http://"+address+"/batch/shard", bytes.NewReader(body))
+		r.Header.Add("Content-Type", "application/json")
+		with_epoch(r)
+		response, err := client.Do(r)
+		if err != nil {
+			continue
+		}
+		var results []BatchResult
+		err = json.NewDecoder(response.Body).Decode(&results)
+		response.Body.Close()
+		if err != nil || response.StatusCode != 200 || len(results) != len(req.Ops) {
+			continue
+		}
+		return results
+	}
+	results := make([]BatchResult, len(req.Ops))
+	for i, op := range req.Ops {
+		results[i] = BatchResult{Op: op.Op, Key: op.Key, Status: 503, Error: "upstream down"}
+	}
+	return results
+}
+
+// handler for POST /kvs/batch, this node coordinates the batch
+func kvs_batch(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	if !v.inView {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	if len(req.Ops) == 0 || len(req.Ops) > maxBatch {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a batch takes 1 to 1000 operations"})
+		return
+	}
+	for i := range req.Ops {
+		req.Ops[i].Op = strings.ToLower(req.Ops[i].Op)
+		if _, ok := batchOps[req.Ops[i].Op]; !ok || req.Ops[i].Key == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad operation"})
+			return
+		}
+	}
+	if _, ok := consistency_level(req.Consistency, writeConsistency); !ok {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad consistency level"})
+		return
+	}
+	if v.current.Shard == 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "divide by 0"})
+		return
+	}
+	if req.Vector == nil {
+		req.Vector = CausalContext{}
+	}
+
+	//which operations go to which shard, remembering where they were
+	groups := make(map[int][]int)
+	for i, op := range req.Ops {
+		shard := shard_of(op.Key, v.current)
+		groups[shard] = append(groups[shard], i)
+	}
+
+	results := make([]BatchResult, len(req.Ops))
+	var wg sync.WaitGroup
+	for shard, indexes := range groups {
+		wg.Add(1)
+		go func(shard int, indexes []int) {
+			defer wg.Done()
+			group := BatchRequest{Vector: req.Vector, Consistency: req.Consistency}
+			for _, i := range indexes {
+				group.Ops = append(group.Ops, req.Ops[i])
+			}
+			var answers []BatchResult
+			if shard == v.selfID {
+				answers = run_group(r.Context(), group.Ops, group.Vector, group.Consistency)
+			} else {
+				answers = send_group(v.shards[shard], group)
+			}
+			for j, i := range indexes {
+				results[i] = answers[j]
+			}
+		}(shard, indexes)
+	}
+	wg.Wait()
+
+	vectorCombined := req.Vector.copy()
+	for i := range results {
+		vectorCombined.merge(results[i].Vector)
+		results[i].Vector = nil
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(struct {
+		Results []BatchResult `json:"results"`
+		Version CausalContext `json:"causal-metadata"`
+	}{results, vectorCombined})
+}
+
+// handler for a coordinator sending this shard its part of a batch
+func batch_shard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	v := load_view()
+	if !v.inView {
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	if !check_epoch(w, r, v) {
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	for i := range req.Ops {
+		if _, ok := batchOps[req.Ops[i].Op]; !ok {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad operation"})
+			return
+		}
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(run_group(r.Context(), req.Ops, req.Vector, req.Consistency))
+}
@@ -0,0 +1,178 @@
+// Package client talks to the key-value store over its HTTP API. It
+// carries the causal metadata between calls so applications don't have
+// to, and moves on to another node when one can't answer. It keeps the
+// view of the cluster and places keys the way the nodes do, so requests
+// go straight to a replica of the owning shard instead of being forwarded
+// there; a node answering with a newer view epoch makes it fetch the view again.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ErrNotFound is returned for a key that doesn't exist or was deleted.
+var ErrNotFound = errors.New("client: key not found")
+
+// ErrUnavailable is returned when no node could answer the request.
+var ErrUnavailable = errors.New("client: no node available")
+
+// StatusError is an answer the store gave that isn't a success.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: store answered %d: %s", e.Code, e.Message)
+}
+
+// Context is the causal metadata the store hands out, the newest write
+// of each replica by shard id.
+type Context map[int]map[string]uint64
+
+func (c Context) copy() Context {
+	out := make(Context, len(c))
+	for shard, clock := range c {
+		out[shard] = make(map[string]uint64, len(clock))
+		for node, counter := range clock {
+			out[shard][node] = counter
+		}
+	}
+	return out
+}
+
+// merge adds other to c, keeping the newest write of every replica
+func (c Context) merge(other Context) {
+	for shard, clock := range other {
+		if c[shard] == nil {
+			c[shard] = make(map[string]uint64, len(clock))
+		}
+		for node, counter := range clock {
+			if counter > c[shard][node] {
+				c[shard][node] = counter
+			}
+		}
+	}
+}
+
+// Client sends requests to the nodes of one cluster. It's safe to use
+// from many goroutines, and so are the sessions it hands out.
+type Client struct {
+	// HTTP does the requests, http.DefaultClient when nil.
+	HTTP *http.Client
+
+	mu sync.Mutex
+	//the nodes it was given, until it has a view
+	seeds []string
+	top   topology
+	//the newest view epoch a node answered with
+	newest uint64
+	//the last node that answered, tried first
+	preferred string
+}
+
+// New gives back a client for the cluster the given nodes (host:port)
+// are in. It learns about the rest from the view.
+func New(nodes ...string) *Client {
+	return &Client{seeds: append([]string(nil), nodes...)}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) prefer(node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.preferred = node
+}
+
+// what the store answers to a request on a key
+type answer struct {
+	Value   json.RawMessage `json:"val"`
+	Error   string          `json:"error"`
+	Context Context         `json:"causal-metadata"`
+}
+
+// sends one request to a single node and decodes the answer into out
+func (c *Client) try(ctx context.Context, node string, method string, path string, body []byte, out interface{}) (int, error) {
+	r, err := http.NewRequestWithContext(ctx, method, "http://"+node+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	//a node with a newer view refuses the request instead of routing it
+	//by ours, and every node says which epoch it's at
+	if epoch := c.epoch(); epoch != "" {
+		r.Header.Set("X-View-Epoch", epoch)
+	}
+	response, err := c.httpClient().Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	c.saw(response.Header.Get("X-View-Epoch"))
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil && response.StatusCode == http.StatusOK {
+		return 0, err
+	}
+	return response.StatusCode, nil
+}
+
+// sends a request on key to the replicas of its shard, going through the
+// nodes until one isn't unavailable. Once all of them were, or one said the
+// client's view is out of date, the view is fetched again and the nodes get
+// one more try each. A view that's still out of date after that is the
+// client's problem and not the store's, so it gives back ErrUnavailable
+func (c *Client) send(ctx context.Context, method string, key string, body interface{}) (int, answer, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, answer{}, err
+	}
+	path := "/kvs/data/" + url.PathEscape(key)
+	var last error = ErrUnavailable
+	for pass := 0; pass < 2; pass++ {
+		if pass > 0 || c.outdated() {
+			//without a view at all it can still go through the seeds
+			if err := c.Refresh(ctx); err != nil && pass > 0 {
+				break
+			}
+		}
+	nodes:
+		for _, node := range c.order(key) {
+			var res answer
+			code, err := c.try(ctx, node, method, path, payload, &res)
+			if ctx.Err() != nil {
+				return 0, answer{}, ctx.Err()
+			}
+			if err != nil {
+				last = err
+				continue
+			}
+			switch code {
+			//503 is a node that can't get enough replicas, or that timed
+			//out waiting for the writes the session depends on. 418 is
+			//one that isn't in the view
+			case http.StatusServiceUnavailable, http.StatusTeapot:
+				last = &StatusError{code, res.Error}
+				continue
+			//routed by an older view than the node has
+			case http.StatusConflict:
+				last = ErrUnavailable
+				break nodes
+			}
+			c.prefer(node)
+			return code, res, nil
+		}
+	}
+	return 0, answer{}, last
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"138_assignment2/partition"
+)
+
+// a node that moved to a newer view refuses the request, the client
+// fetches the view and sends it where the new one says
+func TestStaleViewRefreshes(t *testing.T) {
+	nodes, c := fakeCluster(t, 2)
+	old, moved := nodes[0], nodes[1]
+	for _, node := range nodes {
+		node.setView(oneShard(1, old))
+	}
+	s := c.Session(Causal)
+	if _, err := s.Get(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes {
+		node.setView(oneShard(2, moved))
+	}
+	old.setAnswer(answering(http.StatusConflict, nil))
+	if _, err := s.Get(context.Background(), "x"); err != nil {
+		t.Fatalf("after the view changed: %v", err)
+	}
+	if n := len(old.requests()); n != 2 {
+		t.Errorf("the node that left got %d requests, want 2", n)
+	}
+	if n := len(moved.requests()); n != 1 {
+		t.Errorf("the node of the new view got %d requests, want 1", n)
+	}
+	if c.epoch() != "2" {
+		t.Errorf("client is at epoch %s, want 2", c.epoch())
+	}
+}
+
+// a view that's still stale after fetching it again isn't the store's fault
+func TestStaleViewTwice(t *testing.T) {
+	nodes, c := fakeCluster(t, 2)
+	for _, node := range nodes {
+		node.setAnswer(answering(http.StatusConflict, nil))
+	}
+	_, err := c.Session(Causal).Get(context.Background(), "x")
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestOrderOwnersFirst(t *testing.T) {
+	v := view{NumShards: 2, Epoch: 1, Partitioner: partition.Config{Kind: partition.KindRing}}
+	v.Shards = append(v.Shards, struct {
+		Shard int      `json:"shard_id"`
+		Nodes []string `json:"nodes"`
+	}{0, []string{"a", "b"}}, struct {
+		Shard int      `json:"shard_id"`
+		Nodes []string `json:"nodes"`
+	}{1, []string{"c", "d"}})
+	top, ok := topologyOf(v)
+	if !ok {
+		t.Fatal("no topology from the view")
+	}
+	ring, _ := partition.New(partition.KindRing, 2, 0)
+	//a key of each shard
+	keys := map[int]string{}
+	for i := 0; len(keys) < 2; i++ {
+		key := "key" + string(rune('a'+i))
+		if _, ok := keys[ring.Shard(key)]; !ok {
+			keys[ring.Shard(key)] = key
+		}
+	}
+
+	c := New("seed")
+	if got := c.order(keys[0]); !reflect.DeepEqual(got, []string{"seed"}) {
+		t.Errorf("without a view got %v, want the seeds", got)
+	}
+	c.top = top
+	tests := []struct {
+		key       string
+		preferred string
+		want      []string
+	}{
+		{keys[0], "", []string{"a", "b", "c", "d"}},
+		{keys[1], "", []string{"c", "d", "a", "b"}},
+		//the one that answered last goes first among the owners
+		{keys[1], "d", []string{"d", "c", "a", "b"}},
+		//but not ahead of them when it isn't one
+		{keys[0], "d", []string{"a", "b", "c", "d"}},
+	}
+	for _, test := range tests {
+		c.prefer(test.preferred)
+		if got := c.order(test.key); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("order(%q) preferring %q = %v, want %v", test.key, test.preferred, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Guarantee is a session guarantee, they combine with |.
+type Guarantee int
+
+const (
+	// ReadYourWrites makes reads see every write the session made.
+	ReadYourWrites Guarantee = 1 << iota
+	// MonotonicReads makes reads never see an older state than the
+	// session's reads before.
+	MonotonicReads
+	// WritesFollowReads orders writes after everything the session read,
+	// anyone who sees the write sees what it was based on too.
+	WritesFollowReads
+
+	// Causal is all of them.
+	Causal = ReadYourWrites | MonotonicReads | WritesFollowReads
+)
+
+// Session keeps the causal metadata of a sequence of requests and sends
+// along the parts its guarantees need. A node that can't catch up to them
+// in time answers 503, and the request moves on to another one.
+type Session struct {
+	client     *Client
+	guarantees Guarantee
+
+	mu sync.Mutex
+	//what the session's writes and reads depended on and made
+	writes Context
+	reads  Context
+}
+
+// Session starts a session with the given guarantees.
+func (c *Client) Session(guarantees Guarantee) *Session {
+	return &Session{client: c, guarantees: guarantees, writes: Context{}, reads: Context{}}
+}
+
+// Resume starts a session that carries on from the metadata another one
+// had, see Session.Context.
+func (c *Client) Resume(guarantees Guarantee, from Context) *Session {
+	s := c.Session(guarantees)
+	s.writes.merge(from)
+	s.reads.merge(from)
+	return s
+}
+
+// Context is everything the session has seen so far, to hand over to
+// another session or process.
+func (s *Session) Context() Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.writes.copy()
+	out.merge(s.reads)
+	return out
+}
+
+// the metadata a read has to wait for
+func (s *Session) readContext() Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := Context{}
+	if s.guarantees&ReadYourWrites != 0 {
+		out.merge(s.writes)
+	}
+	if s.guarantees&MonotonicReads != 0 {
+		out.merge(s.reads)
+	}
+	return out
+}
+
+// the metadata a write gets ordered after
+func (s *Session) writeContext() Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := Context{}
+	if s.guarantees&WritesFollowReads != 0 {
+		out.merge(s.reads)
+	}
+	return out
+}
+
+func (s *Session) sawRead(ctx Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads.merge(ctx)
+}
+
+func (s *Session) sawWrite(ctx Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes.merge(ctx)
+}
+
+// what the session sends to /kvs/data/{key}
+type request struct {
+	Value   string  `json:"val"`
+	Context Context `json:"causal-metadata"`
+}
+
+// Get reads key. A typed key's value comes back as its JSON.
+func (s *Session) Get(ctx context.Context, key string) (string, error) {
+	code, res, err := s.client.send(ctx, http.MethodGet, key, request{Context: s.readContext()})
+	if err != nil {
+		return "", err
+	}
+	//a miss still depended on what the node had
+	s.sawRead(res.Context)
+	switch code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", ErrNotFound
+	default:
+		return "", &StatusError{code, res.Error}
+	}
+	var value string
+	if json.Unmarshal(res.Value, &value) != nil {
+		return string(res.Value), nil
+	}
+	return value, nil
+}
+
+// Put writes value to key.
+func (s *Session) Put(ctx context.Context, key string, value string) error {
+	code, res, err := s.client.send(ctx, http.MethodPut, key, request{Value: value, Context: s.writeContext()})
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return &StatusError{code, res.Error}
+	}
+	s.sawWrite(res.Context)
+	return nil
+}
+
+// Delete deletes key.
+func (s *Session) Delete(ctx context.Context, key string) error {
+	code, res, err := s.client.send(ctx, http.MethodDelete, key, request{Context: s.writeContext()})
+	if err != nil {
+		return err
+	}
+	switch code {
+	case http.StatusOK:
+		s.sawWrite(res.Context)
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return &StatusError{code, res.Error}
+}
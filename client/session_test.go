@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a node that answers like the store would, however the test wants
+type fakeNode struct {
+	*httptest.Server
+	mu sync.Mutex
+	//the causal metadata of every data request it got
+	got []Context
+	//how it answers a data request, 200 with nothing when nil
+	answer  func(method string, key string) (int, answer)
+	current view
+}
+
+func (n *fakeNode) address() string {
+	return n.Listener.Addr().String()
+}
+
+func (n *fakeNode) setView(v view) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.current = v
+}
+
+func (n *fakeNode) setAnswer(answer func(method string, key string) (int, answer)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.answer = answer
+}
+
+func (n *fakeNode) requests() []Context {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Context(nil), n.got...)
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	v, answerWith := n.current, n.answer
+	n.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-View-Epoch", strconv.FormatUint(v.Epoch, 10))
+	if r.URL.Path == "/kvs/admin/view" {
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	var req request
+	json.NewDecoder(r.Body).Decode(&req)
+	n.mu.Lock()
+	n.got = append(n.got, req.Context)
+	n.mu.Unlock()
+	code, res := http.StatusOK, answer{Value: json.RawMessage(`"v"`)}
+	if answerWith != nil {
+		code, res = answerWith(r.Method, strings.TrimPrefix(r.URL.Path, "/kvs/data/"))
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// a view with every node in one shard
+func oneShard(epoch uint64, nodes ...*fakeNode) view {
+	v := view{NumShards: 1, Epoch: epoch}
+	v.Shards = append(v.Shards, struct {
+		Shard int      `json:"shard_id"`
+		Nodes []string `json:"nodes"`
+	}{0, nil})
+	for _, n := range nodes {
+		v.Shards[0].Nodes = append(v.Shards[0].Nodes, n.address())
+	}
+	return v
+}
+
+// n nodes in one shard and a client that knows about them
+func fakeCluster(t *testing.T, n int) ([]*fakeNode, *Client) {
+	t.Helper()
+	nodes := []*fakeNode{}
+	for i := 0; i < n; i++ {
+		node := &fakeNode{}
+		node.Server = httptest.NewServer(node)
+		t.Cleanup(node.Close)
+		nodes = append(nodes, node)
+	}
+	addresses := []string{}
+	for _, node := range nodes {
+		node.setView(oneShard(1, nodes...))
+		addresses = append(addresses, node.address())
+	}
+	return nodes, New(addresses...)
+}
+
+// answers every request with the given status and metadata
+func answering(code int, ctx Context) func(string, string) (int, answer) {
+	return func(string, string) (int, answer) {
+		return code, answer{Value: json.RawMessage(`"v"`), Context: ctx}
+	}
+}
+
+func clock(node string, counter uint64) Context {
+	return Context{0: {node: counter}}
+}
+
+func TestSessionGuarantees(t *testing.T) {
+	wrote, read := clock("a", 5), clock("b", 3)
+	tests := []struct {
+		name       string
+		guarantees Guarantee
+		//what the get after the put and the get sends, then the put after both
+		get, put Context
+	}{
+		{"read your writes", ReadYourWrites, wrote, Context{}},
+		{"monotonic reads", MonotonicReads, read, Context{}},
+		{"writes follow reads", WritesFollowReads, Context{}, read},
+		{"causal", Causal, Context{0: {"a": 5, "b": 3}}, read},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		nodes, c := fakeCluster(t, 1)
+		node := nodes[0]
+		s := c.Session(test.guarantees)
+
+		node.setAnswer(answering(http.StatusOK, wrote))
+		if err := s.Put(ctx, "x", "1"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		node.setAnswer(answering(http.StatusOK, read))
+		if _, err := s.Get(ctx, "x"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if _, err := s.Get(ctx, "x"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := s.Put(ctx, "y", "2"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		got := node.requests()
+		if len(got) != 4 {
+			t.Fatalf("%s: the node got %d requests, want 4", test.name, len(got))
+		}
+		//a session starts out depending on nothing
+		if len(got[0]) != 0 {
+			t.Errorf("%s: first put sent %v", test.name, got[0])
+		}
+		if !reflect.DeepEqual(got[2], test.get) {
+			t.Errorf("%s: get sent %v, want %v", test.name, got[2], test.get)
+		}
+		if !reflect.DeepEqual(got[3], test.put) {
+			t.Errorf("%s: put sent %v, want %v", test.name, got[3], test.put)
+		}
+	}
+}
+
+// a node that can't answer in time sends the request on to the next one
+func TestSessionUnavailableMovesOn(t *testing.T) {
+	nodes, c := fakeCluster(t, 2)
+	nodes[0].setAnswer(answering(http.StatusServiceUnavailable, nil))
+	s := c.Session(Causal)
+	if _, err := s.Get(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(nodes[0].requests()); n != 1 {
+		t.Errorf("the unavailable node got %d requests, want 1", n)
+	}
+	if n := len(nodes[1].requests()); n != 1 {
+		t.Errorf("the next node got %d requests, want 1", n)
+	}
+	//it answered, so it's tried first from now on
+	if _, err := s.Get(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(nodes[0].requests()); n != 1 {
+		t.Errorf("the unavailable node was tried again first")
+	}
+
+	nodes[1].setAnswer(answering(http.StatusServiceUnavailable, nil))
+	_, err := s.Get(context.Background(), "x")
+	var status *StatusError
+	if !errors.As(err, &status) || status.Code != http.StatusServiceUnavailable {
+		t.Errorf("with every node unavailable got %v, want a 503", err)
+	}
+}
+
+// a miss still depended on what the node had, the next read waits for it
+func TestSessionNotFoundKeepsContext(t *testing.T) {
+	nodes, c := fakeCluster(t, 1)
+	missed := clock("a", 7)
+	nodes[0].setAnswer(answering(http.StatusNotFound, missed))
+	s := c.Session(MonotonicReads)
+	if _, err := s.Get(context.Background(), "x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if got := s.Context(); !reflect.DeepEqual(got, missed) {
+		t.Errorf("session has %v after the miss, want %v", got, missed)
+	}
+	nodes[0].setAnswer(nil)
+	if _, err := s.Get(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got := nodes[0].requests(); !reflect.DeepEqual(got[1], missed) {
+		t.Errorf("the read after the miss sent %v, want %v", got[1], missed)
+	}
+}
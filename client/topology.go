@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"138_assignment2/partition"
+)
+
+// the view as GET /kvs/admin/view gives it
+type view struct {
+	Shards []struct {
+		Shard int      `json:"shard_id"`
+		Nodes []string `json:"nodes"`
+	} `json:"view"`
+	NumShards   int                  `json:"num_shards"`
+	Epoch       uint64               `json:"epoch"`
+	Keyspaces   []partition.Keyspace `json:"keyspaces"`
+	Partitioner partition.Config     `json:"partitioner"`
+}
+
+// what the client knows about the cluster, enough to find the replicas
+// of a key's shard without asking a node to forward the request
+type topology struct {
+	epoch     uint64
+	shards    [][]string
+	numShards int
+	keyspaces []partition.Keyspace
+	placer    partition.Partitioner
+}
+
+func topologyOf(v view) (topology, bool) {
+	t := topology{epoch: v.Epoch, numShards: v.NumShards, keyspaces: v.Keyspaces}
+	for _, shard := range v.Shards {
+		if shard.Shard < 0 {
+			continue
+		}
+		for len(t.shards) <= shard.Shard {
+			t.shards = append(t.shards, nil)
+		}
+		t.shards[shard.Shard] = shard.Nodes
+	}
+	if t.numShards == 0 {
+		t.numShards = len(t.shards)
+	}
+	if t.numShards == 0 {
+		//a node that isn't in a view yet knows no one
+		return topology{}, false
+	}
+	placer, err := partition.New(v.Partitioner.Kind, t.numShards, v.Partitioner.VNodes)
+	if err != nil {
+		//a placement it doesn't know, the nodes forward for it
+		placer = nil
+	}
+	t.placer = placer
+	return t, true
+}
+
+// the replicas of the shard key lives on, nil when it can't tell
+func (t topology) owners(key string) []string {
+	shard := -1
+	if ks := partition.FindKeyspace(t.keyspaces, key); ks != nil {
+		shard = ks.Shard(key, t.numShards)
+	} else if t.placer != nil {
+		shard = t.placer.Shard(key)
+	}
+	if shard < 0 || shard >= len(t.shards) {
+		return nil
+	}
+	return t.shards[shard]
+}
+
+func (t topology) nodes() []string {
+	out := []string{}
+	for _, nodes := range t.shards {
+		out = append(out, nodes...)
+	}
+	return out
+}
+
+// the nodes to try for key: the replicas of its shard, the one that
+// answered last first, then every other node, which forward the request
+func (c *Client) order(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	all := c.seeds
+	owners := []string(nil)
+	if c.top.numShards > 0 {
+		all = c.top.nodes()
+		owners = c.top.owners(key)
+	}
+	out := make([]string, 0, len(all))
+	seen := make(map[string]bool, len(all))
+	for _, node := range owners {
+		if node == c.preferred {
+			out = append([]string{node}, out...)
+		} else {
+			out = append(out, node)
+		}
+		seen[node] = true
+	}
+	for _, node := range all {
+		if !seen[node] {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// notes the view epoch a node answered with, a newer one than the
+// client's means its topology is out of date
+func (c *Client) saw(header string) {
+	epoch, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch > c.newest {
+		c.newest = epoch
+	}
+}
+
+func (c *Client) outdated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.top.numShards == 0 || c.top.epoch < c.newest
+}
+
+// the epoch to route requests with, empty before the first view
+func (c *Client) epoch() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.top.numShards == 0 {
+		return ""
+	}
+	return strconv.FormatUint(c.top.epoch, 10)
+}
+
+// Refresh fetches the current view of the cluster, which nodes are in
+// each shard and how keys are placed on the shards.
+func (c *Client) Refresh(ctx context.Context) error {
+	var last error = ErrUnavailable
+	updated := false
+	//the nodes it started from too, in case every node it knew of left
+	nodes := c.order("")
+	c.mu.Lock()
+	nodes = append(nodes, c.seeds...)
+	c.mu.Unlock()
+	for _, node := range nodes {
+		var v view
+		code, err := c.try(ctx, node, http.MethodGet, "/kvs/admin/view", nil, &v)
+		if err != nil {
+			last = err
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		t, ok := topologyOf(v)
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		//another request might have fetched a newer one meanwhile
+		if t.epoch >= c.top.epoch || c.top.numShards == 0 {
+			c.top = t
+		}
+		behind := c.top.epoch < c.newest
+		c.mu.Unlock()
+		updated = true
+		//this node hasn't caught up with the newest view either
+		if behind {
+			continue
+		}
+		return nil
+	}
+	if updated {
+		return nil
+	}
+	return last
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Conditional writes. A PUT or DELETE on /kvs/data/{key} can say what it
+// expects the key to be, and only goes through if every condition it set
+// still holds on the owning shard's copy. Otherwise nothing is written and
+// the client gets a 412 with what the key is now, so it can retry.
+type Condition struct {
+	//the key doesn't exist or was deleted
+	IfAbsent bool `json:"if-absent,omitempty"`
+	//the key's version is exactly this one
+	IfVersion *uint64 `json:"if-version,omitempty"`
+	//the key's clock, the "clock" a read or write answers with, is exactly this one
+	IfVector vclock.VClock `json:"if-clock,omitempty"`
+	//the key holds exactly this value
+	IfValue *string `json:"if-value,omitempty"`
+}
+
+// whether the client set any condition at all
+func (c Condition) set() bool {
+	return c.IfAbsent || c.IfVersion != nil || c.IfVector != nil || c.IfValue != nil
+}
+
+// the condition for a raft command, nil when there isn't one
+func (c Condition) command() *Condition {
+	if !c.set() {
+		return nil
+	}
+	return &c
+}
+
+// checks every condition against the current version of the key
+func (c Condition) holds(item KVS, found bool, now time.Time) bool {
+	live := present(item, found, now)
+	if c.IfAbsent && live {
+		return false
+	}
+	if c.IfVersion != nil && (!live || item.Version != *c.IfVersion) {
+		return false
+	}
+	if c.IfVector != nil && (!live || !item.Vector.Compare(c.IfVector, vclock.Equal)) {
+		return false
+	}
+	if c.IfValue != nil && (!live || item.Value != *c.IfValue) {
+		return false
+	}
+	return true
+}
+
+// conditional writes on a shard are all coordinated by its first live
+// replica, so two clients racing on the same key can't both win on
+// different replicas. Sends the write there unless that's this node,
+// gives back its answer and whether it did
+func forward_conditional(method string, k string, req DataRequest, v viewState) (dataResult, bool) {
+	if !req.Condition.set() || v.current.Shard == 0 {
+		return dataResult{}, false
+	}
+	upstream := v.shards[shard_of(k, v.current)]
+	nodes := live_first(upstream.Node)
+	if len(nodes) == 0 || nodes[0] == os.Getenv("ADDRESS") {
+		return dataResult{}, false
+	}
+	return relay(method, "/kvs/data/"+k, req, NodeShards{upstream.Shard, nodes[:1]}), true
+}
+
+// tells the client its condition didn't hold and what the key is now
+func precondition_failed(item KVS, found bool) dataResult {
+	if !present(item, found, time.Now()) {
+		return answer_with(412, struct {
+			Error  string `json:"error"`
+			Exists bool   `json:"exists"`
+		}{"precondition failed", false})
+	}
+	return answer_with(412, struct {
+		Error   string        `json:"error"`
+		Exists  bool          `json:"exists"`
+		Value   string        `json:"val"`
+		Version uint64        `json:"version"`
+		Vector  vclock.VClock `json:"clock"`
+	}{"precondition failed", true, item.Value, item.Version, item.Vector})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Typed keys whose concurrent updates merge instead of clobbering each
+// other. Each one is changed through its own operation on
+// POST /kvs/data/{key}/{op} and its whole state travels with the key, so
+// gossip, replication and rebalancing merge it the same way everywhere:
+//
+//	counter   PN-counter, "incr" with "by" (negative to decrement)
+//	set       OR-set, "add" and "remove" with "element"
+//	register  LWW-register, "set" with "val"
+//	map       OR-map of LWW-registers, "add" with "field" and "val",
+//	          "remove" with "field"
+//
+// An add that was concurrent with a remove wins, the remove only takes
+// out the adds it saw.
+const (
+	CrdtCounter  = "counter"
+	CrdtSet      = "set"
+	CrdtRegister = "register"
+	CrdtMap      = "map"
+)
+
+type CRDT struct {
+	Type string `json:"type"`
+	//counter: what each replica added and took away
+	P map[string]uint64 `json:"p,omitempty"`
+	N map[string]uint64 `json:"n,omitempty"`
+	//set and map: the tags each element (or field) was added with,
+	//and the tags that were removed since
+	Adds    map[string]map[string]bool `json:"adds,omitempty"`
+	Removed map[string]bool            `json:"removed,omitempty"`
+	//register
+	Register *Register `json:"register,omitempty"`
+	//map: the value of each field
+	Fields map[string]Register `json:"fields,omitempty"`
+}
+
+// the last write wins by its stamp, registers from before there were
+// stamps go by Time and ties to the bigger node address
+type Register struct {
+	Value string    `json:"val"`
+	Time  time.Time `json:"time"`
+	Node  string    `json:"node"`
+	HLC   HLC       `json:"hlc"`
+}
+
+// what a client sends to /kvs/data/{key}/{op}
+type crdtRequest struct {
+	By      int64         `json:"by"`
+	Element string        `json:"element"`
+	Field   string        `json:"field"`
+	Value   string        `json:"val"`
+	Vector  CausalContext `json:"causal-metadata"`
+	//ONE, QUORUM or ALL, falls back to the cluster default
+	Consistency string `json:"consistency,omitempty"`
+	//seconds until the key expires, an op without one keeps the key's
+	TTL int `json:"ttl,omitempty"`
+}
+
+func new_crdt(kind string) *CRDT {
+	c := &CRDT{Type: kind}
+	switch kind {
+	case CrdtCounter:
+		c.P = make(map[string]uint64)
+		c.N = make(map[string]uint64)
+	case CrdtSet:
+		c.Adds = make(map[string]map[string]bool)
+		c.Removed = make(map[string]bool)
+	case CrdtRegister:
+		c.Register = &Register{}
+	case CrdtMap:
+		c.Adds = make(map[string]map[string]bool)
+		c.Removed = make(map[string]bool)
+		c.Fields = make(map[string]Register)
+	}
+	return c
+}
+
+// a deep copy, versions in the store are shared so they never get changed in place
+func (c *CRDT) copy() *CRDT {
+	out := new_crdt(c.Type)
+	out.merge(c)
+	return out
+}
+
+// takes in everything the other replica's state has seen
+func (c *CRDT) merge(o *CRDT) {
+	for node, n := range o.P {
+		if n > c.P[node] {
+			c.P[node] = n
+		}
+	}
+	for node, n := range o.N {
+		if n > c.N[node] {
+			c.N[node] = n
+		}
+	}
+	for element, tags := range o.Adds {
+		if c.Adds[element] == nil {
+			c.Adds[element] = make(map[string]bool)
+		}
+		for tag := range tags {
+			c.Adds[element][tag] = true
+		}
+	}
+	for tag := range o.Removed {
+		c.Removed[tag] = true
+	}
+	if o.Register != nil {
+		c.Register = newer_register(*c.Register, *o.Register)
+	}
+	for field, reg := range o.Fields {
+		if cur, ok := c.Fields[field]; ok {
+			c.Fields[field] = *newer_register(cur, reg)
+		} else {
+			c.Fields[field] = reg
+		}
+	}
+}
+
+func newer_register(a Register, b Register) *Register {
+	if !a.HLC.zero() || !b.HLC.zero() {
+		if a.HLC.before(b.HLC) {
+			return &b
+		}
+		return &a
+	}
+	if b.Time.After(a.Time) || (b.Time.Equal(a.Time) && b.Node > a.Node) {
+		return &b
+	}
+	return &a
+}
+
+// whether an element (or field) has an add that wasn't removed
+func (c *CRDT) present(element string) bool {
+	for tag := range c.Adds[element] {
+		if !c.Removed[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// the live elements (or fields), sorted
+func (c *CRDT) elements() []string {
+	out := []string{}
+	for element := range c.Adds {
+		if c.present(element) {
+			out = append(out, element)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// the value the client sees
+func (c *CRDT) value() interface{} {
+	switch c.Type {
+	case CrdtCounter:
+		var total int64
+		for _, n := range c.P {
+			total += int64(n)
+		}
+		for _, n := range c.N {
+			total -= int64(n)
+		}
+		return total
+	case CrdtSet:
+		return c.elements()
+	case CrdtRegister:
+		return c.Register.Value
+	case CrdtMap:
+		out := make(map[string]string)
+		for _, field := range c.elements() {
+			out[field] = c.Fields[field].Value
+		}
+		return out
+	}
+	return nil
+}
+
+// the value as it's kept in KVS.Value, so plain reads and
+// everything that only looks at the string still work
+func (c *CRDT) render() string {
+	if c.Type == CrdtRegister {
+		return c.Register.Value
+	}
+	out, _ := json.Marshal(c.value())
+	return string(out)
+}
+
+// what type the operation works on, from the op and the fields the client sent
+func crdt_type(op string, req crdtRequest) (string, bool) {
+	switch op {
+	case "incr":
+		return CrdtCounter, true
+	case "set":
+		return CrdtRegister, true
+	case "add", "remove":
+		if req.Field != "" {
+			return CrdtMap, true
+		}
+		if req.Element != "" {
+			return CrdtSet, true
+		}
+	}
+	return "", false
+}
+
+// the tag an add gets, the dot of the write that made it. No two
+// writes share a dot, the clock can give two of them the same time
+func dot_tag(dot Dot) string {
+	return fmt.Sprintf("%s#%d", dot.Node, dot.Counter)
+}
+
+// applies one operation on top of the state, dot is the write's
+func (c *CRDT) apply(op string, req crdtRequest, dot Dot, now time.Time) {
+	self := os.Getenv("ADDRESS")
+	switch op {
+	case "incr":
+		by := req.By
+		if by == 0 {
+			by = 1
+		}
+		if by > 0 {
+			c.P[self] += uint64(by)
+		} else {
+			c.N[self] += uint64(-by)
+		}
+	case "set":
+		c.Register = &Register{req.Value, now, self, clock.at(now)}
+	case "add":
+		element := req.Element
+		if c.Type == CrdtMap {
+			element = req.Field
+			c.Fields[element] = Register{req.Value, now, self, clock.at(now)}
+		}
+		if c.Adds[element] == nil {
+			c.Adds[element] = make(map[string]bool)
+		}
+		c.Adds[element][dot_tag(dot)] = true
+	case "remove":
+		element := req.Element
+		if c.Type == CrdtMap {
+			element = req.Field
+		}
+		//only the adds this replica has seen
+		for tag := range c.Adds[element] {
+			c.Removed[tag] = true
+		}
+	}
+}
+
+// both versions of the key with their CRDT states merged
+func merge_crdt(a KVS, b KVS) KVS {
+	out := merge_meta(a, b)
+	state := a.CRDT.copy()
+	state.merge(b.CRDT)
+	out.CRDT = state
+	out.Value = state.render()
+	out.Siblings = nil
+	return out
+}
+
+func same_crdt(a *CRDT, b *CRDT) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+// answers a read of a typed key with its value
+func crdt_answer(item KVS, ctx CausalContext) dataResult {
+	return answer_with(200, struct {
+		Type    string        `json:"type"`
+		Value   interface{}   `json:"val"`
+		Version CausalContext `json:"causal-metadata"`
+	}{item.CRDT.Type, item.CRDT.value(), ctx})
+}
+
+// handler for the operations on typed keys
+func crdt_op(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	if !v.inView {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !check_epoch(w, r, v) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	k, op := vars["key"], vars["op"]
+	var req crdtRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	kind, ok := crdt_type(op, req)
+	if !ok {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown operation"})
+		return
+	}
+	if len(k) > 2048 || len(req.Value) > 8000000 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "key/val too large"})
+		return
+	}
+	if req.TTL < 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad ttl"})
+		return
+	}
+	level, ok := consistency_level(req.Consistency, writeConsistency)
+	if !ok {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad consistency level"})
+		return
+	}
+	if v.current.Shard == 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "divide by 0"})
+		return
+	}
+	targetShard := shard_of(k, v.current)
+	if targetShard != v.selfID {
+		for _, upstream := range v.shards {
+			if upstream.Shard == targetShard {
+				forward_to(w, "POST", "/kvs/data/"+k+"/"+op, req, upstream)
+				return
+			}
+		}
+	}
+	//the raft log only knows about plain values
+	if linearizable(k) {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "linearizable keys can't hold a " + kind})
+		return
+	}
+	if res, ok := txn_guard("POST", "/kvs/data/"+k+"/"+op, k, req, v); ok {
+		res.write(w)
+		return
+	}
+	if req.Vector == nil {
+		req.Vector = CausalContext{}
+	}
+
+	holds := ""
+	dot := dots.next()
+	defer dots.done(dot)
+	item, err := store.Update(k, func(item KVS, found bool) (KVS, bool) {
+		live := present(item, found, time.Now())
+		state := new_crdt(kind)
+		if live && item.CRDT == nil {
+			holds = "a plain value"
+			return item, false
+		}
+		if live {
+			if item.CRDT.Type != kind {
+				holds = "a " + item.CRDT.Type
+				return item, false
+			}
+			state = item.CRDT.copy()
+		}
+		now := time.Now()
+		state.apply(op, req, dot, now)
+		next := put_item(item, found, k, state.render(), req.Vector.for_shard(v), dot, now)
+		next.CRDT = state
+		next.Siblings = nil
+		//an op changes the value, it doesn't take back the key's ttl
+		if req.TTL > 0 {
+			next.Expires = expiry(req.TTL, now)
+		} else if live {
+			next.Expires = item.Expires
+		}
+		return next, true
+	})
+	if err != nil {
+		storage_error(w, err)
+		return
+	}
+	if holds != "" {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(map[string]string{"error": "key holds " + holds})
+		return
+	}
+
+	peers := shard_peers(v)
+	need := required(level, len(peers)+1)
+	if acks := replicate(item, peers, need); acks < need {
+		quorum_failure(acks, need).write(w)
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(struct {
+		Value   interface{}   `json:"val"`
+		Version CausalContext `json:"causal-metadata"`
+	}{item.CRDT.value(), req.Vector.with(v.selfID, item.Vector)})
+}
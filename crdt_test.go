@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+type crdtStep struct {
+	op  string
+	req crdtRequest
+}
+
+// a replica's version of the key: base with the steps applied on node
+func diverge(t *testing.T, base KVS, node string, steps ...crdtStep) KVS {
+	t.Helper()
+	t.Setenv("ADDRESS", node)
+	out := base
+	out.CRDT = base.CRDT.copy()
+	for i, step := range steps {
+		dot := Dot{node, uint64(i + 1)}
+		out.CRDT.apply(step.op, step.req, dot, time.Now())
+		out.Vector = with_dot(out.Vector, dot)
+		out.Version++
+	}
+	out.Value = out.CRDT.render()
+	return out
+}
+
+func same_merge(a KVS, b KVS) bool {
+	return same_crdt(a.CRDT, b.CRDT) && a.Value == b.Value && reflect.DeepEqual(a.CRDT.value(), b.CRDT.value())
+}
+
+func TestCRDTMergeLaws(t *testing.T) {
+	tests := []struct {
+		kind string
+		//what every replica starts from, then what each of three does
+		base     []crdtStep
+		replicas [3][]crdtStep
+	}{
+		{CrdtCounter, []crdtStep{{"incr", crdtRequest{By: 2}}}, [3][]crdtStep{
+			{{"incr", crdtRequest{By: 5}}},
+			{{"incr", crdtRequest{By: -3}}, {"incr", crdtRequest{}}},
+			{{"incr", crdtRequest{By: -1}}},
+		}},
+		{CrdtSet, []crdtStep{{"add", crdtRequest{Element: "x"}}}, [3][]crdtStep{
+			{{"remove", crdtRequest{Element: "x"}}, {"add", crdtRequest{Element: "y"}}},
+			{{"add", crdtRequest{Element: "x"}}},
+			{{"add", crdtRequest{Element: "z"}}, {"remove", crdtRequest{Element: "z"}}},
+		}},
+		{CrdtRegister, []crdtStep{{"set", crdtRequest{Value: "0"}}}, [3][]crdtStep{
+			{{"set", crdtRequest{Value: "a"}}},
+			{{"set", crdtRequest{Value: "b"}}},
+			{{"set", crdtRequest{Value: "c"}}},
+		}},
+		{CrdtMap, []crdtStep{{"add", crdtRequest{Field: "f", Value: "0"}}}, [3][]crdtStep{
+			{{"remove", crdtRequest{Field: "f"}}, {"add", crdtRequest{Field: "g", Value: "a"}}},
+			{{"add", crdtRequest{Field: "f", Value: "b"}}},
+			{{"add", crdtRequest{Field: "g", Value: "c"}}},
+		}},
+	}
+	for _, test := range tests {
+		base := diverge(t, KVS{Key: "k", CRDT: new_crdt(test.kind), Vector: vclock.New()}, "base", test.base...)
+		versions := []KVS{}
+		for i, steps := range test.replicas {
+			versions = append(versions, diverge(t, base, fmt.Sprintf("r%d", i), steps...))
+		}
+		a, b, c := versions[0], versions[1], versions[2]
+
+		for i, v := range versions {
+			if merged := merge_crdt(v, v); !same_merge(merged, v) {
+				t.Errorf("%s: merging replica %d with itself gave %v, want %v", test.kind, i, merged.Value, v.Value)
+			}
+		}
+		for _, pair := range [][2]KVS{{a, b}, {a, c}, {b, c}, {base, a}} {
+			x, y := pair[0], pair[1]
+			if xy, yx := merge_crdt(x, y), merge_crdt(y, x); !same_merge(xy, yx) {
+				t.Errorf("%s: merge isn't commutative, %v and %v", test.kind, xy.Value, yx.Value)
+			}
+		}
+		left := merge_crdt(merge_crdt(a, b), c)
+		right := merge_crdt(a, merge_crdt(b, c))
+		if !same_merge(left, right) {
+			t.Errorf("%s: merge isn't associative, %v and %v", test.kind, left.Value, right.Value)
+		}
+		//merging in something already seen changes nothing
+		if again := merge_crdt(left, b); !same_merge(again, left) {
+			t.Errorf("%s: merging a replica in again gave %v, want %v", test.kind, again.Value, left.Value)
+		}
+	}
+}
+
+// an add concurrent with a remove of the same element wins
+func TestCRDTAddWins(t *testing.T) {
+	base := diverge(t, KVS{Key: "k", CRDT: new_crdt(CrdtSet), Vector: vclock.New()}, "base", crdtStep{"add", crdtRequest{Element: "x"}})
+	removed := diverge(t, base, "r0", crdtStep{"remove", crdtRequest{Element: "x"}})
+	added := diverge(t, base, "r1", crdtStep{"add", crdtRequest{Element: "x"}})
+	if got := merge_crdt(removed, added).CRDT.value(); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("got %v, want the concurrent add of x kept", got)
+	}
+	if got := merge_crdt(removed, base).CRDT.value(); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("got %v, want x removed", got)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Dotted version vectors. Every write gets a dot: the replica that took
+// it and the next number of that replica's counter, which counts every
+// write the replica takes, whatever the key. A key's clock holds the
+// newest dot it has seen from each replica, so it grows with the number
+// of replicas and not the number of keys, and two versions of a key are
+// concurrent exactly when neither clock covers the other. Reads and
+// writes answer with the key's clock as "clock", for if-clock.
+//
+// The causal metadata clients carry is a vector like that for every
+// shard: the newest write from each replica of the shard they depend on.
+// A write merges the client's vector for the shard into the key's clock,
+// so it covers every version of the key the client could have seen.
+// A replica knows it has everything from another one up to some number
+// once an anti-entropy round with it finishes, the replica says how far
+// its knowledge went when the round starts. A read waits until this
+// node's knowledge covers the client's vector for its shard.
+type Dot struct {
+	Node    string `json:"node"`
+	Counter uint64 `json:"counter"`
+}
+
+// what clients send and get back as causal-metadata, by shard id
+type CausalContext map[int]vclock.VClock
+
+// a copy with clock merged into the shard's vector
+func (c CausalContext) with(shard int, clock vclock.VClock) CausalContext {
+	out := c.copy()
+	if out[shard] == nil {
+		out[shard] = vclock.New()
+	}
+	out[shard].Merge(clock)
+	return out
+}
+
+// the client's vector for this node's shard, without entries for nodes
+// that aren't replicas of it
+func (c CausalContext) for_shard(v viewState) vclock.VClock {
+	out := vclock.New()
+	if v.selfID < 0 || v.selfID >= len(v.shards) {
+		return out
+	}
+	for _, node := range v.shards[v.selfID].Node {
+		if counter, ok := c[v.selfID][node]; ok {
+			out[node] = counter
+		}
+	}
+	return out
+}
+
+func (c CausalContext) copy() CausalContext {
+	out := make(CausalContext, len(c))
+	for shard, clock := range c {
+		out[shard] = clock.Copy()
+	}
+	return out
+}
+
+func (c CausalContext) merge(other CausalContext) {
+	for shard, clock := range other {
+		if c[shard] == nil {
+			c[shard] = vclock.New()
+		}
+		c[shard].Merge(clock)
+	}
+}
+
+type dotCounter struct {
+	mu      sync.Mutex
+	counter uint64
+	//dots handed out whose write isn't in the store yet
+	inflight map[uint64]bool
+}
+
+var dots = &dotCounter{inflight: make(map[uint64]bool)}
+
+// starts the counter past every dot this node handed out before. The
+// versions holding the newest ones might be gone (collected, or moved to
+// another shard), so it never starts below the time in microseconds
+// either, which is more than the node could have handed out
+func load_dots() {
+	self := os.Getenv("ADDRESS")
+	start := uint64(time.Now().UnixMicro())
+	store.Range(func(item KVS) bool {
+		if item.Vector[self] > start {
+			start = item.Vector[self]
+		}
+		return true
+	})
+	dots.counter = start
+}
+
+// the dot for a write this node is about to take, call done once it's in
+// the store (or didn't happen)
+func (d *dotCounter) next() Dot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counter++
+	d.inflight[d.counter] = true
+	return Dot{os.Getenv("ADDRESS"), d.counter}
+}
+
+func (d *dotCounter) done(dot Dot) {
+	d.mu.Lock()
+	delete(d.inflight, dot.Counter)
+	d.mu.Unlock()
+	causal.notify()
+}
+
+// how far this node's own writes are all in the store
+func (d *dotCounter) stable() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stable := d.counter
+	for counter := range d.inflight {
+		if counter <= stable {
+			stable = counter - 1
+		}
+	}
+	return stable
+}
+
+// adds the dot to a clock, giving back a new one
+func with_dot(clock vclock.VClock, dot Dot) vclock.VClock {
+	out := vclock.New()
+	if clock != nil {
+		out = clock.Copy()
+	}
+	if dot.Counter > out[dot.Node] {
+		out[dot.Node] = dot.Counter
+	}
+	return out
+}
+
+type causalKnowledge struct {
+	mu sync.Mutex
+	//how far this node has every write of each other replica
+	known   vclock.VClock
+	changed chan struct{}
+}
+
+var causal = &causalKnowledge{known: vclock.New()}
+
+// this node's knowledge, its own writes included
+func (k *causalKnowledge) snapshot() vclock.VClock {
+	k.mu.Lock()
+	out := k.known.Copy()
+	k.mu.Unlock()
+	out[os.Getenv("ADDRESS")] = dots.stable()
+	return out
+}
+
+// adds what another replica knew at the start of a finished round
+func (k *causalKnowledge) learn(known vclock.VClock) {
+	self := os.Getenv("ADDRESS")
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for node, counter := range known {
+		if node != self && counter > k.known[node] {
+			k.known[node] = counter
+		}
+	}
+	k.wake()
+}
+
+// wakes up the reads waiting on the knowledge
+func (k *causalKnowledge) notify() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.wake()
+}
+
+func (k *causalKnowledge) wake() {
+	if k.changed != nil {
+		close(k.changed)
+		k.changed = nil
+	}
+}
+
+// gives back a channel that gets closed the next time the knowledge grows
+func (k *causalKnowledge) grown() <-chan struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.changed == nil {
+		k.changed = make(chan struct{})
+	}
+	return k.changed
+}
+
+// the replicas of the shard this node is behind on for the client's
+// vector, entries for nodes outside the shard are left out
+func (k *causalKnowledge) behind(needs vclock.VClock, members []string) []string {
+	known := k.snapshot()
+	lagging := []string{}
+	for _, node := range members {
+		if known[node] < needs[node] {
+			lagging = append(lagging, node)
+		}
+	}
+	return lagging
+}
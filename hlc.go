@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Hybrid logical clocks. Every write and every view change is stamped
+// with one: the wall time the node saw, a counter for writes within the
+// same nanosecond or behind a clock it heard about, and the node's
+// address. A node moves its clock past every stamp it hears about, in the
+// header on requests between nodes and on the keys gossip brings in, so
+// the stamps follow causality even when the wall clocks don't agree. Two
+// concurrent versions of a key are ordered by their stamps instead of the
+// raw wall time, which makes every replica pick the same one and keeps a
+// node whose clock runs ahead from always winning. A stamp more than
+// HLC_MAX_SKEW milliseconds ahead of this node's wall clock is refused,
+// the clock doesn't follow it so one bad clock can't drag every node's
+// stamps along, and raises an alarm, see GET /kvs/admin/clock.
+type HLC struct {
+	//unix nanoseconds
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+// the header the sender's clock goes in
+const clockHeader = "X-HLC"
+
+var maxClockSkew = time.Second
+
+type skewAlarm struct {
+	Node  string    `json:"node"`
+	Ahead float64   `json:"ahead_ms"`
+	At    time.Time `json:"at"`
+}
+
+type hybridClock struct {
+	mu     sync.Mutex
+	last   HLC
+	alarms int
+	latest *skewAlarm
+}
+
+var clock = &hybridClock{}
+
+func load_clock() {
+	maxClockSkew = env_duration("HLC_MAX_SKEW", time.Millisecond, maxClockSkew)
+}
+
+func (a HLC) zero() bool {
+	return a.Wall == 0 && a.Logical == 0
+}
+
+// whether a comes before b, the node breaks ties between equal times
+func (a HLC) before(b HLC) bool {
+	if a.Wall != b.Wall {
+		return a.Wall < b.Wall
+	}
+	if a.Logical != b.Logical {
+		return a.Logical < b.Logical
+	}
+	return a.Node < b.Node
+}
+
+// a stamp for something happening on this node at now
+func (c *hybridClock) at(now time.Time) HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := now.UnixNano(); pt > c.last.Wall {
+		c.last = HLC{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = os.Getenv("ADDRESS")
+	return c.last
+}
+
+func (c *hybridClock) now() HLC {
+	return c.at(time.Now())
+}
+
+// moves the clock past a stamp from another node, unless the stamp is
+// too far ahead
+func (c *hybridClock) observe(sent HLC) {
+	if sent.zero() {
+		return
+	}
+	pt := time.Now().UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ahead := time.Duration(sent.Wall - pt); ahead > maxClockSkew {
+		//only a stamp with no logical part is the sender's own wall clock,
+		//the others might just be passing on someone else's
+		if sent.Logical == 0 {
+			c.alarms++
+			c.latest = &skewAlarm{sent.Node, float64(ahead) / float64(time.Millisecond), time.Now()}
+			fmt.Printf("hlc: %s is %v ahead of this node\n", sent.Node, ahead)
+		}
+		return
+	}
+	switch {
+	case pt > c.last.Wall && pt > sent.Wall:
+		c.last = HLC{Wall: pt}
+	case sent.Wall > c.last.Wall:
+		c.last = HLC{Wall: sent.Wall, Logical: sent.Logical + 1}
+	case sent.Wall == c.last.Wall && sent.Logical >= c.last.Logical:
+		c.last.Logical = sent.Logical + 1
+	default:
+		c.last.Logical++
+	}
+	c.last.Node = os.Getenv("ADDRESS")
+}
+
+// whether version a of a key was written before b. Versions from before
+// there were stamps fall back to their wall time
+func written_before(a KVS, b KVS) bool {
+	if a.HLC.zero() && b.HLC.zero() {
+		return a.Time.Before(b.Time)
+	}
+	return a.HLC.before(b.HLC)
+}
+
+// stamps a request to another node with this node's clock
+func with_clock(r *http.Request) {
+	stamp, _ := json.Marshal(clock.now())
+	r.Header.Set(clockHeader, string(stamp))
+}
+
+// picks up the clock of whoever sent the request
+func observe_clock(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sent := r.Header.Get(clockHeader); sent != "" {
+			var stamp HLC
+			if json.Unmarshal([]byte(sent), &stamp) == nil {
+				clock.observe(stamp)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler for GET /kvs/admin/clock
+func get_clock(w http.ResponseWriter, r *http.Request) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(struct {
+		HLC     HLC        `json:"hlc"`
+		MaxSkew float64    `json:"max_skew_ms"`
+		Alarms  int        `json:"skew_alarms"`
+		Latest  *skewAlarm `json:"last_alarm"`
+	}{clock.last, float64(maxClockSkew) / float64(time.Millisecond), clock.alarms, clock.latest})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLCRemoteAhead(t *testing.T) {
+	t.Setenv("ADDRESS", "self")
+	c := &hybridClock{}
+	sent := HLC{Wall: time.Now().Add(maxClockSkew / 2).UnixNano(), Logical: 3, Node: "other"}
+	c.observe(sent)
+	if c.last.Wall != sent.Wall || c.last.Logical != 4 {
+		t.Fatalf("clock is at %+v after seeing %+v, want just past it", c.last, sent)
+	}
+	//the wall clock is still behind, so the counter keeps going
+	next := c.now()
+	if !sent.before(next) || next.Wall != sent.Wall || next.Logical != 5 {
+		t.Errorf("stamped %+v after seeing %+v", next, sent)
+	}
+	//an older stamp doesn't take it back
+	c.observe(HLC{Wall: sent.Wall - 1, Logical: 9, Node: "other"})
+	if c.last.Wall != sent.Wall || c.last.Logical != 6 {
+		t.Errorf("clock is at %+v after seeing an older stamp", c.last)
+	}
+}
+
+func TestHLCSameWallTime(t *testing.T) {
+	t.Setenv("ADDRESS", "self")
+	c := &hybridClock{}
+	//ahead of the wall clock, so observe doesn't move past it either
+	now := time.Now().Add(maxClockSkew / 2)
+	first, second := c.at(now), c.at(now)
+	if first.Logical != 0 || second.Wall != first.Wall || second.Logical != 1 {
+		t.Errorf("two stamps at the same time: %+v, %+v", first, second)
+	}
+	//a wall clock going back doesn't either
+	if third := c.at(now.Add(-time.Millisecond)); third.Wall != first.Wall || third.Logical != 2 {
+		t.Errorf("stamp after the wall clock went back: %+v", third)
+	}
+	//a stamp at the same time with a higher counter moves the counter past it
+	c.observe(HLC{Wall: first.Wall, Logical: 7, Node: "other"})
+	if c.last.Wall != first.Wall || c.last.Logical != 8 {
+		t.Errorf("clock is at %+v after seeing counter 7", c.last)
+	}
+	if next := c.at(now.Add(time.Millisecond)); next.Wall != now.Add(time.Millisecond).UnixNano() || next.Logical != 0 {
+		t.Errorf("a later wall time didn't reset the counter: %+v", next)
+	}
+}
+
+func TestHLCRefusesTooFarAhead(t *testing.T) {
+	t.Setenv("ADDRESS", "self")
+	c := &hybridClock{}
+	before := c.now()
+	far := HLC{Wall: time.Now().Add(maxClockSkew + time.Minute).UnixNano(), Node: "fast"}
+	c.observe(far)
+	if c.last != before {
+		t.Errorf("clock followed a stamp %v ahead to %+v", maxClockSkew+time.Minute, c.last)
+	}
+	if c.alarms != 1 || c.latest == nil || c.latest.Node != "fast" {
+		t.Errorf("no alarm for fast, got %d alarms, last %+v", c.alarms, c.latest)
+	}
+	//one it's passing on is refused too, but isn't the sender's clock
+	c.observe(HLC{Wall: far.Wall, Logical: 2, Node: "fast"})
+	if c.last != before || c.alarms != 1 {
+		t.Errorf("passed on stamp: clock at %+v with %d alarms", c.last, c.alarms)
+	}
+	if next := c.now(); !before.before(next) || !next.before(far) {
+		t.Errorf("stamp %+v after refusing %+v", next, far)
+	}
+}
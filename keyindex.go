@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The store's keys in order. The stripes are hash maps, so listings and
+// scans walk this skip list instead of copying and sorting every key for
+// each page. The store adds a key the first time it's written and drops it
+// when it's removed, both while the key's stripe is locked, so the index
+// always has the same keys as the maps.
+const indexLevels = 24
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+type keyIndex struct {
+	mu    sync.RWMutex
+	head  indexNode
+	level int
+	rng   *rand.Rand
+}
+
+func new_index() *keyIndex {
+	return &keyIndex{
+		head:  indexNode{next: make([]*indexNode, indexLevels)},
+		level: 1,
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// the last node on each level before key, must be called with mu held
+func (x *keyIndex) before(key string) [indexLevels]*indexNode {
+	var path [indexLevels]*indexNode
+	node := &x.head
+	for l := x.level - 1; l >= 0; l-- {
+		for node.next[l] != nil && node.next[l].key < key {
+			node = node.next[l]
+		}
+		path[l] = node
+	}
+	return path
+}
+
+func (x *keyIndex) insert(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	path := x.before(key)
+	if next := path[0].next[0]; next != nil && next.key == key {
+		return
+	}
+	//every level up holds a quarter of the keys of the one below
+	level := 1
+	for level < indexLevels && x.rng.Intn(4) == 0 {
+		level++
+	}
+	for l := x.level; l < level; l++ {
+		path[l] = &x.head
+	}
+	if level > x.level {
+		x.level = level
+	}
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = path[l].next[l]
+		path[l].next[l] = node
+	}
+}
+
+func (x *keyIndex) remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	path := x.before(key)
+	node := path[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for l := range node.next {
+		path[l].next[l] = node.next[l]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+func (x *keyIndex) clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.head.next = make([]*indexNode, indexLevels)
+	x.level = 1
+}
+
+// at most n keys from from on, in order
+func (x *keyIndex) from(from string, n int) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	keys := make([]string, 0, n)
+	for node := x.before(from)[0].next[0]; node != nil && len(keys) < n; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
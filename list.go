@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Listing keys across the whole cluster. GET /kvs/keys asks one replica
+// of every shard for its keys in order, merges the answers and hands back
+// at most limit of them with a cursor for the next page. The cursor is
+// just the last key of the page (and the prefix), so paging stays stable
+// even when keys move between shards in the middle of it.
+//
+//	prefix       only keys starting with it
+//	start_after  only keys sorting after it
+//	limit        page size, 100 by default and at most 1000
+//	cursor       the cursor of the previous page, replaces prefix and start_after
+//	values       "true" to get each key's value and version as well
+const defaultListLimit = 100
+const maxListLimit = 1000
+
+// one key in a listing
+type ListEntry struct {
+	Key     string        `json:"key"`
+	Value   string        `json:"val,omitempty"`
+	Version uint64        `json:"version,omitempty"`
+	Vector  vclock.VClock `json:"clock,omitempty"`
+}
+
+// what a page starts from, what goes in the cursor
+type listPosition struct {
+	Prefix     string `json:"prefix,omitempty"`
+	StartAfter string `json:"start_after,omitempty"`
+	//a scan's bounds, from is inclusive and to isn't
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+type listQuery struct {
+	listPosition
+	Limit  int
+	Values bool
+}
+
+func (q listQuery) encode() string {
+	params := url.Values{}
+	params.Set("prefix", q.Prefix)
+	params.Set("start_after", q.StartAfter)
+	params.Set("from", q.From)
+	params.Set("to", q.To)
+	params.Set("limit", strconv.Itoa(q.Limit))
+	params.Set("values", strconv.FormatBool(q.Values))
+	return params.Encode()
+}
+
+func encode_cursor(pos listPosition) string {
+	data, _ := json.Marshal(pos)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decode_cursor(cursor string) (listPosition, bool) {
+	var pos listPosition
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(data, &pos) != nil {
+		return pos, false
+	}
+	return pos, true
+}
+
+// reads the query string, gives back false if something in it is bad
+func parse_list_query(params url.Values) (listQuery, bool) {
+	q := listQuery{Limit: defaultListLimit}
+	q.Prefix = params.Get("prefix")
+	q.StartAfter = params.Get("start_after")
+	q.From = params.Get("from")
+	q.To = params.Get("to")
+	if cursor := params.Get("cursor"); cursor != "" {
+		pos, ok := decode_cursor(cursor)
+		if !ok {
+			return q, false
+		}
+		q.listPosition = pos
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return q, false
+		}
+		q.Limit = n
+	}
+	if q.Limit > maxListLimit {
+		q.Limit = maxListLimit
+	}
+	q.Values = params.Get("values") == "true"
+	return q, true
+}
+
+// the first key a page can have
+func (pos listPosition) first() string {
+	first := pos.From
+	if pos.Prefix > first {
+		first = pos.Prefix
+	}
+	//the smallest key after start_after
+	if pos.StartAfter != "" && pos.StartAfter+"\x00" > first {
+		first = pos.StartAfter + "\x00"
+	}
+	return first
+}
+
+// the first limit keys this shard owns that match, in order. Walks the
+// store's index from where the page starts, so a page costs about limit
+// keys and not the whole store
+func list_local(q listQuery) []ListEntry {
+	v := load_view()
+	entries := []ListEntry{}
+	now := time.Now()
+	store.Ascend(q.first(), func(item KVS) bool {
+		//every key after one without the prefix is past it too
+		if !strings.HasPrefix(item.Key, q.Prefix) || (q.To != "" && item.Key >= q.To) {
+			return false
+		}
+		if !present(item, true, now) {
+			return true
+		}
+		//a copy that's still here after the key moved isn't ours to list
+		if v.current.Shard > 0 && shard_of(item.Key, v.current) != v.selfID {
+			return true
+		}
+		entry := ListEntry{Key: item.Key}
+		if q.Values {
+			entry.Value = item.Value
+			entry.Version = item.Version
+			entry.Vector = item.Vector
+		}
+		entries = append(entries, entry)
+		return len(entries) < q.Limit
+	})
+	return entries
+}
+
+// asks the replicas of another shard in turn until one answers
+func list_remote(upstream NodeShards, q listQuery) ([]ListEntry, bool) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	for _, address := range live_first(upstream.Node) {
+		r, _ := http.NewRequest("GET", "http://"+address+"/list/shard?"+q.encode(), nil)
+		with_epoch(r)
+		response, err := client.Do(r)
+		if err != nil {
+			continue
+		}
+		var entries []ListEntry
+		err = json.NewDecoder(response.Body).Decode(&entries)
+		response.Body.Close()
+		if err != nil || response.StatusCode != 200 {
+			continue
+		}
+		return entries, true
+	}
+	return nil, false
+}
+
+// lists the keys of one shard, here or on its replicas
+func list_shard_of(v viewState, upstream NodeShards, q listQuery) ([]ListEntry, bool) {
+	if upstream.Shard == v.selfID {
+		return list_local(q), true
+	}
+	return list_remote(upstream, q)
+}
+
+// handler for GET /kvs/keys, lists the keys of every shard
+func list_keys(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	w.Header().Set("Content-Type", "application/json")
+	if !v.inView {
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	q, ok := parse_list_query(r.URL.Query())
+	if !ok {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad query"})
+		return
+	}
+	list_all(w, v, q)
+}
+
+// asks every shard at once and merges what they sent into one page
+func list_all(w http.ResponseWriter, v viewState, q listQuery) {
+	type answer struct {
+		upstream NodeShards
+		entries  []ListEntry
+		ok       bool
+	}
+	answers := make(chan answer, len(v.shards))
+	for _, upstream := range v.shards {
+		go func(upstream NodeShards) {
+			entries, ok := list_shard_of(v, upstream, q)
+			answers <- answer{upstream, entries, ok}
+		}(upstream)
+	}
+
+	all := []ListEntry{}
+	//some shard might have more than it sent
+	more := false
+	deadline := time.NewTimer(quorumTimeout + time.Second)
+	defer deadline.Stop()
+	for range v.shards {
+		var a answer
+		select {
+		case a = <-answers:
+		case <-deadline.C:
+			a = answer{ok: false}
+		}
+		if !a.ok {
+			//a page with a shard missing would skip its keys for good
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(struct {
+				Error    string     `json:"error"`
+				Upstream NodeShards `json:"upstream"`
+			}{"upstream down", a.upstream})
+			return
+		}
+		if len(a.entries) >= q.Limit {
+			more = true
+		}
+		all = append(all, a.entries...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+	if len(all) > q.Limit {
+		all = all[:q.Limit]
+		more = true
+	}
+
+	list_page(w, q, all, more)
+}
+
+// answers with a page of keys and the cursor for the next one
+func list_page(w http.ResponseWriter, q listQuery, entries []ListEntry, more bool) {
+	cursor := ""
+	if more && len(entries) > 0 {
+		next := q.listPosition
+		next.StartAfter = entries[len(entries)-1].Key
+		cursor = encode_cursor(next)
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(struct {
+		Count  int         `json:"count"`
+		Keys   []ListEntry `json:"keys"`
+		Cursor string      `json:"cursor"`
+	}{len(entries), entries, cursor})
+}
+
+// handler for a coordinator listing this shard's keys
+func list_shard(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	w.Header().Set("Content-Type", "application/json")
+	if !v.inView {
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	if !check_epoch(w, r, v) {
+		return
+	}
+	q, ok := parse_list_query(r.URL.Query())
+	if !ok {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad query"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(list_local(q))
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
-	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"138_assignment2/partition"
+
 	"git.tu-berlin.de/mcc-fred/vclock"
 	"github.com/gorilla/mux"
 	"golang.org/x/exp/slices"
 )
 
 var inView bool
-var ticker time.Ticker
+var ticker *time.Ticker
 
 // This NodeShards shows which nodes are in which INDIVIDUAL shard.
 // Mostly used in the getView function
@@ -32,11 +36,22 @@ type ShardsDisplay struct {
 }
 
 // tracks how many shards there are, and the nodes in the view.
-// This will basically be our "view" struct from the last assignment
+// This will basically be our "view" struct from the last assignment.
+// Every view change bumps the epoch, the request id is the admin
+// request that made it
 type Shards struct {
-	Shard int       `json:"num_shards"`
-	Nodes []string  `json:"nodes"`
-	Time  time.Time `json:"time"`
+	Shard     int      `json:"num_shards"`
+	Nodes     []string `json:"nodes"`
+	Epoch     uint64   `json:"epoch"`
+	RequestID string   `json:"request_id"`
+	//range-partitioned keyspaces, they change with the view so every
+	//node agrees on which shard owns which range
+	Keyspaces []partition.Keyspace `json:"keyspaces,omitempty"`
+	//when the view was made, breaks ties between views with the same epoch
+	HLC HLC `json:"hlc"`
+	//the nodes of each shard, worked out from the view before when the
+	//view is made so nodes stay in their shard as the view changes
+	Groups [][]string `json:"groups,omitempty"`
 }
 
 // probably dont need this anymore
@@ -45,236 +60,382 @@ type Views struct {
 }
 
 type KVS struct {
-	Key     string        `json:"key"`
-	Value   string        `json:"val"`
-	Vector  vclock.VClock `json:"causal-metadata"`
-	Version uint64        `json:"version"`
-	Time    time.Time     `json:"time"`
+	Key   string `json:"key"`
+	Value string `json:"val"`
+	//a tombstone, Vector is the clock of the delete
+	Deleted bool `json:"deleted,omitempty"`
+	//the newest dot of every replica this version has seen
+	Vector vclock.VClock `json:"causal-metadata"`
+	//the write that made this version
+	Dot     Dot       `json:"dot"`
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+	//orders concurrent versions, Time is only kept for display
+	HLC HLC `json:"hlc"`
+	//every concurrent value, only in sibling mode
+	Siblings []Sibling `json:"siblings,omitempty"`
+	//the state of a counter, set, register or map
+	CRDT *CRDT `json:"crdt,omitempty"`
+	//when the key runs out, nil if it never does
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
-var keys []KVS
 var display ShardsDisplay
 var current Shards
 var numShards int
 var selfID int
 var getView []NodeShards
 
-// check if a version vclock is greater/equal to request
-func check_version(r vclock.VClock) bool {
-	//for all the keys, check if a local key is equal or a descendant of the request key
-	//idk if this works
-	for _, k := range keys {
-		//look if the key exists
-		version, found := r.FindTicks(k.Key)
-		if !found {
-			continue
+// guards inView, current, getView and selfID
+var viewMu sync.RWMutex
+
+// a copy of the view that a handler can keep using
+// without holding on to the lock
+type viewState struct {
+	current Shards
+	shards  []NodeShards
+	selfID  int
+	inView  bool
+}
+
+func load_view() viewState {
+	viewMu.RLock()
+	defer viewMu.RUnlock()
+	return viewState{current, getView, selfID, inView}
+}
+
+// whether view a came after view b. Two admin requests racing on
+// different nodes can end up with the same epoch, the request id
+// breaks the tie so every node still picks the same one
+func newer_view(a, b Shards) bool {
+	if a.Epoch != b.Epoch {
+		return a.Epoch > b.Epoch
+	}
+	if a.HLC != b.HLC {
+		return b.HLC.before(a.HLC)
+	}
+	return a.RequestID > b.RequestID
+}
+
+func same_view(a, b Shards) bool {
+	return a.Epoch == b.Epoch && a.RequestID == b.RequestID
+}
+
+// every data request carries the epoch of the view it was routed with
+const epochHeader = "X-View-Epoch"
+
+// stamps an outgoing request with this node's view epoch and clock
+func with_epoch(r *http.Request) {
+	r.Header.Set(epochHeader, strconv.FormatUint(load_view().current.Epoch, 10))
+	with_clock(r)
+}
+
+// what a node answers when the caller's view is out of date
+type staleView struct {
+	Error     string       `json:"error"`
+	Shard     int          `json:"num_shards"`
+	Epoch     uint64       `json:"epoch"`
+	RequestID string       `json:"request_id"`
+	View      []NodeShards `json:"view"`
+}
+
+func stale_view(w http.ResponseWriter, v viewState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(409)
+	json.NewEncoder(w).Encode(staleView{"stale view", v.current.Shard, v.current.Epoch, v.current.RequestID, v.shards})
+}
+
+// refuses a request that was routed with an older view than ours and
+// sends back the current one. Requests without an epoch are let through
+func check_epoch(w http.ResponseWriter, r *http.Request, v viewState) bool {
+	w.Header().Set(epochHeader, strconv.FormatUint(v.current.Epoch, 10))
+	sent := r.Header.Get(epochHeader)
+	if sent == "" {
+		return true
+	}
+	epoch, err := strconv.ParseUint(sent, 10, 64)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad view epoch"})
+		return false
+	}
+	if epoch < v.current.Epoch {
+		stale_view(w, v)
+		return false
+	}
+	return true
+}
+
+// the highest epoch any of the nodes has, so a new view beats
+// everything that is out there even if this node missed some of it
+func highest_epoch(nodes []string) uint64 {
+	client := http.Client{
+		Timeout: time.Second * 1,
+	}
+	answers := make(chan uint64, len(nodes))
+	for _, address := range nodes {
+		go func(address string) {
+			response, err := client.Get("http://" + address + "/kvs/admin/view")
+			if err != nil {
+				answers <- 0
+				return
+			}
+			defer response.Body.Close()
+			var view struct {
+				Epoch uint64 `json:"epoch"`
+			}
+			json.NewDecoder(response.Body).Decode(&view)
+			answers <- view.Epoch
+		}(address)
+	}
+	var highest uint64
+	for range nodes {
+		if epoch := <-answers; epoch > highest {
+			highest = epoch
 		}
-		if version < k.Version {
+	}
+	return highest
+}
+
+// blocks until this node has every write of its shard the request's
+// metadata depends on, gives back false if that didn't happen within causalTimeout
+func wait_for_version(rctx context.Context, ctx CausalContext, v viewState) bool {
+	if v.selfID < 0 || v.selfID >= len(v.shards) {
+		return true
+	}
+	needs := ctx[v.selfID]
+	//a dead replica won't send anything more, don't wait on it
+	members := live_first(v.shards[v.selfID].Node)
+	deadline := time.NewTimer(causalTimeout)
+	defer deadline.Stop()
+	pulled := false
+	for {
+		//grab the channel before checking so knowledge that comes
+		//in between still wakes us up
+		grown := causal.grown()
+		lagging := causal.behind(needs, members)
+		if len(lagging) == 0 {
+			return true
+		}
+		//pull from the ones we're behind on now instead of waiting for gossip
+		if !pulled {
+			pulled = true
+			for _, address := range lagging {
+				if address != os.Getenv("ADDRESS") {
+					go anti_entropy(address)
+				}
+			}
+		}
+		select {
+		case <-grown:
+		case <-deadline.C:
+			return false
+		case <-rctx.Done():
 			return false
 		}
 	}
-	//else false
-	return true
 }
 
+// how long a read waits for its causal dependencies to show up, set by
+// CAUSAL_TIMEOUT in seconds
+var causalTimeout = 20 * time.Second
+
 // gets the kvs
 func get_kvs(w http.ResponseWriter, r *http.Request) {
-	if !inView {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(418)
-		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
-		return
-	}
-	time.Sleep(time.Second)
-
-	w.Header().Set("Content-Type", "application/json")
-
 	//gets the JSON body
-	vars := mux.Vars(r)
-	k := vars["key"]
-	var key KVS
+	var key DataRequest
 	_ = json.NewDecoder(r.Body).Decode(&key)
+	get_key(r.Context(), mux.Vars(r)["key"], key).write(w)
+}
 
-	//if there's a vclock in find if the KVS has updated to it so far
-	//this ideally should have a 500 error if 20 seconds have passed
+// reads a key for a client, whether it came in on its own or in a batch
+func get_key(rctx context.Context, k string, key DataRequest) dataResult {
+	v := load_view()
+	if !v.inView {
+		return answer_with(418, map[string]string{"error": "uninitialized"})
+	}
 
-	//checks if it's in memory
-	//do we have to tick the vector for gets as well?
-	for _, item := range keys {
-		if item.Key == k && item.Value != "" {
-			value := item.Value
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Value   string        `json:"val"`
-				Version vclock.VClock `json:"causal-metadata"`
-			}{value, item.Vector})
-			return
-		}
+	level, ok := consistency_level(key.Consistency, readConsistency)
+	if !ok {
+		return answer_with(400, map[string]string{"error": "bad consistency level"})
+	}
+
+	if v.current.Shard == 0 {
+		return answer_with(400, map[string]string{"error": "divide by 0"})
 	}
-	hashed_key := hash(k) //% uint64(current.Shard)
-	hash_key_64 := int64(hashed_key)
-	bucketNumber := jump_hash(hash_key_64, len(current.Nodes))
 	//the bucket number will choose one of the addresses,
 	//and we can get the shard of this address.
-	targetShard := bucketNumber % current.Shard
-	//fmt.Printf("target shard: %#v\n myShard: %#v\n", targetShard, selfID)
-	set_shardView()
+	targetShard := shard_of(k, v.current)
+	//fmt.Printf("target shard: %#v\n myShard: %#v\n", targetShard, v.selfID)
 
 	designatedIndex := 0
 
-	for j := 0; j < len(getView); j++ {
-		if getView[j].Shard == targetShard {
+	for j := 0; j < len(v.shards); j++ {
+		if v.shards[j].Shard == targetShard {
 			designatedIndex = j
 		}
 	}
-	if targetShard != selfID {
-		vector := make(chan vclock.VClock)
-		value := make(chan string)
-		for _, eachAddress := range getView[designatedIndex].Node {
-			go func(address string, vector chan vclock.VClock) {
-				client := http.Client{
-					Timeout: time.Second * 20,
-				}
-				view_marshalled, _ := json.Marshal(key)
-				r, _ := http.NewRequest("GET", "http://"+address+"/kvs/data/"+k, strings.NewReader(string(view_marshalled)))
-				r.Header.Add("Content-Type", "application/json")
-				response, err := client.Do(r)
-				if err != nil {
-					return
-				}
-				res := KVS{}
-				json.NewDecoder(response.Body).Decode(&res)
-				response.Body.Close()
-				vector <- res.Vector
-				value <- res.Value
+	if targetShard != v.selfID {
+		if linearizable(k) {
+			//only the owning shard's leader can answer this one
+			return relay("GET", "/kvs/data/"+k, key, v.shards[designatedIndex])
+		}
+		return read_fan_out(k, key, level, v.shards[designatedIndex])
+	}
+	if linearizable(k) {
+		return raft_read(rctx, k, key)
+	}
 
-			}(eachAddress, vector)
+	//wait for this node to have every write of the shard the client has seen
+	if !wait_for_version(rctx, key.Vector, v) {
+		return answer_with(503, map[string]string{"error": "timed out while waiting for depended updates"})
+	}
 
+	//checks if it's in memory, then with the rest of the shard
+	//if the client asked for more than one replica
+	//do we have to tick the vector for gets as well?
+	item, found := store.Get(k)
+	peers := shard_peers(v)
+	need := required(level, len(peers)+1)
+	item, found, answers := read_quorum(k, item, found, peers, need)
+	if answers < need {
+		return answer_with(503, struct {
+			Error    string `json:"error"`
+			Answers  int    `json:"answers"`
+			Required int    `json:"required"`
+		}{"not enough replicas", answers, need})
+	}
+	if present(item, found, time.Now()) {
+		ctx := key.Vector.with(v.selfID, item.Vector)
+		if item.CRDT != nil {
+			return crdt_answer(item, ctx)
 		}
-
-		select {
-		case res := <-vector:
-			value := <-value
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Value   string        `json:"val"`
-				Version vclock.VClock `json:"causal-metadata"`
-			}{value, res})
-		case <-time.After(20 * time.Second):
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(503)
-			json.NewEncoder(w).Encode(struct {
-				Error    string     `json:"error"`
-				Upstream NodeShards `json:"upstream"`
-			}{"upstream down", getView[designatedIndex]})
+		if siblings_for(k) {
+			return sibling_answer(item, ctx)
 		}
-		return
+		value := item.Value
+		return answer_with(200, struct {
+			Value   string        `json:"val"`
+			Clock   vclock.VClock `json:"clock"`
+			Version CausalContext `json:"causal-metadata"`
+		}{value, item.Vector, ctx})
 	}
 
-	w.WriteHeader(404)
-	json.NewEncoder(w).Encode(struct {
-		Version vclock.VClock `json:"causal-metadata"`
+	return answer_with(404, struct {
+		Version CausalContext `json:"causal-metadata"`
 	}{key.Vector})
 }
 
 // deletes the kvs
 func delete_kvs(w http.ResponseWriter, r *http.Request) {
-	if !inView {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(418)
-		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-
 	//gets the JSON body
-	vars := mux.Vars(r)
-	k := vars["key"]
-	var key KVS
+	var key DataRequest
 	_ = json.NewDecoder(r.Body).Decode(&key)
+	delete_key(r.Context(), mux.Vars(r)["key"], key).write(w)
+}
 
-	//checks if it's in memory, if so delete it
-	for index, item := range keys {
-		if item.Key == k && item.Value != "" {
-			//ticker.Stop()
-			item.Value = ""
-			item.Version += 1
-			//increment clock
-			item.Vector.Tick(item.Key)
-			key.Time = time.Now()
-			keys = append(keys[:index], keys[index+1:]...)
-			keys = append(keys, item)
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Version vclock.VClock `json:"causal-metadata"`
-			}{item.Vector})
-			return
-		}
+// deletes a key for a client, whether it came in on its own or in a batch
+func delete_key(rctx context.Context, k string, key DataRequest) dataResult {
+	v := load_view()
+	if !v.inView {
+		return answer_with(418, map[string]string{"error": "uninitialized"})
 	}
 
-	hashed_key := hash(k) //% uint64(current.Shard)
-	hash_key_64 := int64(hashed_key)
-	bucketNumber := jump_hash(hash_key_64, len(current.Nodes))
-	if current.Shard == 0 {
-		w.WriteHeader(400)
-		json.NewEncoder(w).Encode(map[string]string{"error": "divide by 0"})
-		return
+	level, ok := consistency_level(key.Consistency, writeConsistency)
+	if !ok {
+		return answer_with(400, map[string]string{"error": "bad consistency level"})
 	}
-	targetShard := bucketNumber % current.Shard
-	//f("target shard: %#v\n myShard: %#v\n", targetShard, selfID)
-	designatedIndex := 0
 
-	for j := 0; j < len(getView); j++ {
-		if getView[j].Shard == targetShard {
-			designatedIndex = j
+	//linearizable keys go through the owning shard's raft log
+	if linearizable(k) && v.current.Shard > 0 {
+		if targetShard := shard_of(k, v.current); targetShard != v.selfID {
+			return relay("DELETE", "/kvs/data/"+k, key, v.shards[targetShard])
 		}
+		return raft_write(rctx, raftCommand{Op: "delete", Key: k, If: key.Condition.command()}, key.Vector)
 	}
-	if targetShard != selfID {
-		vector := make(chan vclock.VClock)
-		for _, eachAddress := range getView[designatedIndex].Node {
-			go func(address string, vector chan vclock.VClock) {
-				client := http.Client{
-					Timeout: time.Second * 20,
-				}
-				view_marshalled, _ := json.Marshal(key)
-				r, _ := http.NewRequest("DELETE", "http://"+address+"/kvs/data/"+k, strings.NewReader(string(view_marshalled)))
-				r.Header.Add("Content-Type", "application/json")
-				response, err := client.Do(r)
-				if err != nil {
-					return
-				}
-				res := KVS{}
-				json.NewDecoder(response.Body).Decode(&res)
-				response.Body.Close()
-				vector <- res.Vector
-			}(eachAddress, vector)
 
+	//a condition is checked against the owning shard's copy, not whatever
+	//this node might still have
+	if res, ok := forward_conditional("DELETE", k, key, v); ok {
+		return res
+	}
+	if res, ok := txn_guard("DELETE", "/kvs/data/"+k, k, key, v); ok {
+		return res
+	}
+
+	//checks if it's in memory, if so delete it
+	deleted := false
+	failed, existed := false, false
+	var written vclock.VClock
+	dot := dots.next()
+	defer dots.done(dot)
+	item, err := store.Update(k, func(item KVS, found bool) (KVS, bool) {
+		now := time.Now()
+		if !key.Condition.holds(item, found, now) {
+			failed, existed = true, found
+			return item, false
+		}
+		//an expired key is already gone, the sweeper tombstones it
+		if !present(item, found, now) {
+			return item, false
 		}
+		//ticker.Stop()
+		deleted = true
+		next := delete_item(item, dot, now)
+		if siblings_for(k) {
+			//the delete only replaces the values the client has seen
+			written = add_sibling(&next, siblings_of(item, found), "", key.Context, next.Time)
+		}
+		return next, true
+	})
+	if err != nil {
+		return storage_failure(err)
+	}
+	if failed {
+		return precondition_failed(item, existed)
+	}
+	if deleted {
+		peers := shard_peers(v)
+		need := required(level, len(peers)+1)
+		if acks := replicate(item, peers, need); acks < need {
+			return quorum_failure(acks, need)
+		}
+		ctx := key.Vector.with(v.selfID, item.Vector)
+		if siblings_for(k) {
+			return sibling_written(item, written, ctx)
+		}
+		return answer_with(200, struct {
+			Clock   vclock.VClock `json:"clock"`
+			Version CausalContext `json:"causal-metadata"`
+		}{item.Vector, ctx})
+	}
 
-		select {
-		case res := <-vector:
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Version vclock.VClock `json:"causal-metadata"`
-			}{res})
-		case <-time.After(20 * time.Second):
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(503)
-			json.NewEncoder(w).Encode(struct {
-				Error    string     `json:"error"`
-				Upstream NodeShards `json:"upstream"`
-			}{"upstream down", getView[designatedIndex]})
+	if v.current.Shard == 0 {
+		return answer_with(400, map[string]string{"error": "divide by 0"})
+	}
+	targetShard := shard_of(k, v.current)
+	//f("target shard: %#v\n myShard: %#v\n", targetShard, v.selfID)
+	designatedIndex := 0
+
+	for j := 0; j < len(v.shards); j++ {
+		if v.shards[j].Shard == targetShard {
+			designatedIndex = j
 		}
-		return
+	}
+	if targetShard != v.selfID {
+		return relay("DELETE", "/kvs/data/"+k, key, v.shards[designatedIndex])
 	}
 
 	//not found
-	w.WriteHeader(404)
-	json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	return answer_with(404, map[string]string{"error": "not found"})
 }
 
 // handles the request based on the method
 func handle_kvs(w http.ResponseWriter, r *http.Request) {
+	if !check_epoch(w, r, load_view()) {
+		return
+	}
 
 	switch r.Method {
 
@@ -321,27 +482,51 @@ func handle_kvs_view(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// must be called with viewMu held.
+// builds a new slice so handlers holding the old one aren't affected,
+// and works out which shard this node is in
 func set_shardView() {
 
-	getView = getView[:0]
-	//fmt.Printf("AFTER DELETE: %v\n", getView)
-	for i := 0; i < current.Shard; i++ {
-		var singularShard NodeShards
-		singularShard.Shard = i
-		nodeList := []string{}
-		getView = append(getView, (NodeShards{
+	shards := []NodeShards{}
+	selfID = -1
+	groups, err := groups_of(current)
+	if err != nil {
+		fmt.Printf("view: %v\n", err)
+		getView = shards
+		return
+	}
+	for i, nodeList := range groups {
+		shards = append(shards, (NodeShards{
 			Shard: i,
 			Node:  nodeList,
 		}))
+		if slices.Contains(nodeList, os.Getenv("ADDRESS")) {
+			selfID = i
+		}
 	}
-	//this for loop actually appends onto the [empty node list] that we
-	//made in the previous for loop
-	for j := 0; j < len(current.Nodes); j++ {
-		shardID := j % current.Shard
-		getView[shardID].Node = append(getView[shardID].Node, current.Nodes[j])
-		//fmt.Printf("VIEW SHARDS: %v\n", getView[shardID].Node)
+	//fmt.Printf("POST RESHARD: %v\n", shards)
+	getView = shards
+}
+
+// the nodes of each shard of a view. One made before views carried
+// them (or by an admin that sent its own) gets the placement's
+func groups_of(v Shards) ([][]string, error) {
+	if len(v.Groups) != v.Shard {
+		return partition.Assign(nil, v.Nodes, v.Shard, placement)
+	}
+	count := 0
+	for _, group := range v.Groups {
+		for _, node := range group {
+			if !slices.Contains(v.Nodes, node) {
+				return partition.Assign(nil, v.Nodes, v.Shard, placement)
+			}
+			count++
+		}
 	}
-	//fmt.Printf("POST RESHARD: %v\n", getView)
+	if count != len(v.Nodes) {
+		return partition.Assign(nil, v.Nodes, v.Shard, placement)
+	}
+	return v.Groups, nil
 }
 
 // returns the current view
@@ -351,9 +536,18 @@ func get_kvs_view(w http.ResponseWriter, r *http.Request) {
 	//{shard_id: i, nodes = [empty node list]}
 
 	//set_shardView()
+	v := load_view()
 	json.NewEncoder(w).Encode(struct {
-		NodesList []NodeShards `json:"view"`
-	}{getView})
+		NodesList []NodeShards         `json:"view"`
+		Shard     int                  `json:"num_shards"`
+		Epoch     uint64               `json:"epoch"`
+		RequestID string               `json:"request_id"`
+		Members   []Member             `json:"members"`
+		Keyspaces []partition.Keyspace `json:"keyspaces"`
+		//so clients can find the owning shard themselves
+		Partitioner partition.Config `json:"partitioner"`
+	}{v.shards, v.current.Shard, v.current.Epoch, v.current.RequestID, swim.list(), v.current.Keyspaces,
+		partition.Config{Kind: partitionerKind, VNodes: vnodes}})
 
 	w.WriteHeader(200)
 
@@ -372,13 +566,52 @@ func indexOf(e string, list []string) int {
 // sets the node view
 func create_kvs_view(w http.ResponseWriter, r *http.Request) {
 	var shardList Shards
-	oldList := current.Nodes
 	_ = json.NewDecoder(r.Body).Decode(&shardList)
+	w.Header().Set("Content-Type", "application/json")
+
+	//ask around so the new epoch is above anything already out there
+	before := load_view()
+	seen := highest_epoch(append(append([]string{}, before.current.Nodes...), shardList.Nodes...))
+
+	viewMu.Lock()
+	//the same admin request again (ex. a retry) changes nothing
+	if shardList.RequestID != "" && shardList.RequestID == current.RequestID {
+		viewMu.Unlock()
+		w.WriteHeader(200)
+		return
+	}
+	if seen < current.Epoch {
+		seen = current.Epoch
+	}
+	//an admin that names its epoch gets refused if it isn't newer
+	if shardList.Epoch != 0 && shardList.Epoch <= seen {
+		v := viewState{current, getView, selfID, inView}
+		viewMu.Unlock()
+		stale_view(w, v)
+		return
+	}
+	epoch := seen + 1
+	if shardList.Epoch != 0 {
+		epoch = shardList.Epoch
+	}
+	if shardList.RequestID == "" {
+		shardList.RequestID = os.Getenv("ADDRESS") + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	oldList := current.Nodes
+	//nodes that stay keep their shard
+	prev := [][]string{}
+	for _, shard := range getView {
+		prev = append(prev, shard.Node)
+	}
+	current.Groups, _ = partition.Assign(prev, shardList.Nodes, shardList.Shard, placement)
 	current.Nodes = shardList.Nodes
 	current.Shard = shardList.Shard
-	current.Time = time.Now()
-	if shardList.Time.Before(current.Time) && !shardList.Time.IsZero() {
-		return
+	current.Epoch = epoch
+	current.RequestID = shardList.RequestID
+	current.HLC = clock.now()
+	//an admin that only changes the nodes keeps the keyspaces as they are
+	if shardList.Keyspaces != nil {
+		current.Keyspaces = shardList.Keyspaces
 	}
 	inView = false
 
@@ -395,60 +628,25 @@ func create_kvs_view(w http.ResponseWriter, r *http.Request) {
 			delete = append(delete, item)
 		}
 	}
+	set_shardView()
+	engine.SetView(current)
+	view := current
+	self := selfID
+	viewMu.Unlock()
+
+	//the removed nodes get the new view so they can hand their keys over
+	view_marshalled, _ := json.Marshal(view)
 	for _, item := range delete {
 		url := "http://" + item + "/kvs/admin/view"
-		r, _ := http.NewRequest("DELETE", url, nil)
+		r, _ := http.NewRequest("DELETE", url, strings.NewReader(string(view_marshalled)))
+		r.Header.Add("Content-Type", "application/json")
 		http.DefaultClient.Do(r)
 	}
-	selfID = indexOf(os.Getenv("ADDRESS"), current.Nodes) % current.Shard
-	set_shardView()
-	k := make(map[int]KVS)
-	for i := 0; i < len(keys); i++ {
-		//if item.Value != "" {
-		hashed_key := hash(keys[i].Key)
-		hash_key_64 := int64(hashed_key)
-		bucketNumber := jump_hash(hash_key_64, len(current.Nodes))
-		targetShard := bucketNumber % current.Shard
-		if targetShard != selfID {
-			//fmt.Println("GET OUT")
-			//if index == len(keys)-1 {
-			//
-			//
-			go func(k KVS) {
-				client := http.Client{
-					Timeout: time.Second * 1,
-				}
-
-				for {
-					url := "http://" + current.Nodes[targetShard] + "/putNo"
-					view_marshalled, _ := json.Marshal(k)
-					r, err := http.NewRequest("PUT", url, strings.NewReader(string(view_marshalled)))
-					if err != nil {
-						//fmt.Println("ERROR IN GOSSIP KVS")
-						continue
-					}
-					r.Header.Add("Content-Type", "application/json")
-					resp, _ := client.Do(r)
-					if resp.StatusCode == 200 {
-						break
-					}
-				}
-			}(keys[i])
-			//
-			//
-			k[targetShard] = keys[i]
-			fmt.Printf("%v\n", keys[i])
-			//}
-			keys = append(keys[:i], keys[i+1:]...)
-			i--
-
-		}
-		//}
-
-	}
+	//keys that belong to another shard now get streamed over in the background
+	rebalance.view_changed(delete)
 
-	for i := 0; i < current.Shard-1; i += 1 {
-		if i == selfID {
+	for i := 0; i < view.Shard-1; i += 1 {
+		if i == self {
 			continue
 		}
 		/*
@@ -520,14 +718,23 @@ func create_kvs_view(w http.ResponseWriter, r *http.Request) {
 func compare_view(w http.ResponseWriter, r *http.Request) {
 	var v Shards
 	_ = json.NewDecoder(r.Body).Decode(&v)
+	clock.observe(v.HLC)
+	viewMu.Lock()
+	defer viewMu.Unlock()
 
 	//maybe add || number shards == 0
-	if len(current.Nodes) == 0 {
+	if len(current.Nodes) == 0 && newer_view(v, current) {
 		//inView = true
 		current.Nodes = v.Nodes
 		current.Shard = v.Shard
+		current.Epoch = v.Epoch
+		current.RequestID = v.RequestID
+		current.Keyspaces = v.Keyspaces
+		current.HLC = v.HLC
+		current.Groups = v.Groups
 		set_shardView()
-		selfID = indexOf(os.Getenv("ADDRESS"), current.Nodes) % current.Shard
+		engine.SetView(current)
+		rebalance.view_changed(nil)
 		return
 	}
 	if !slices.Contains(current.Nodes, os.Getenv("ADDRESS")) {
@@ -543,28 +750,25 @@ func compare_view(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	*/
-	if v.Time.After(current.Time) {
+	if newer_view(v, current) {
 		//fmt.Println("ITS TRUE")
+		var gone []string
+		for _, node := range current.Nodes {
+			if !slices.Contains(v.Nodes, node) {
+				gone = append(gone, node)
+			}
+		}
 		current.Nodes = v.Nodes
 		current.Shard = v.Shard
+		current.Epoch = v.Epoch
+		current.RequestID = v.RequestID
+		current.Keyspaces = v.Keyspaces
+		current.HLC = v.HLC
+		current.Groups = v.Groups
 		set_shardView()
-		selfID = indexOf(os.Getenv("ADDRESS"), current.Nodes) % current.Shard
-		for i := 0; i < len(keys); i++ {
-			//if item.Value != "" {
-			hashed_key := hash(keys[i].Key)
-			hash_key_64 := int64(hashed_key)
-			bucketNumber := jump_hash(hash_key_64, len(current.Nodes))
-			targetShard := bucketNumber % current.Shard
-			if targetShard != selfID {
-				//fmt.Println("GET OUT")
-				//if index == len(keys)-1 {
-
-				//}
-				keys = append(keys[:i], keys[i+1:]...)
-				i--
-			}
-			//}
-		}
+		engine.SetView(current)
+		//the rebalancer moves the keys that aren't ours anymore
+		rebalance.view_changed(gone)
 		/*
 			for index, item := range keys {
 				//if item.Value != "" {
@@ -602,12 +806,30 @@ func compare_view(w http.ResponseWriter, r *http.Request) {
 }
 
 // deletes the node view
+// if the new view comes along, the keys are handed over to it first
 func delete_kvs_view(w http.ResponseWriter, r *http.Request) {
+	var next Shards
+	_ = json.NewDecoder(r.Body).Decode(&next)
+	viewMu.Lock()
 	inView = false
-	keys = nil
-	current.Nodes = current.Nodes[:0]
+	if len(next.Nodes) > 0 && next.Shard > 0 {
+		rebalance.hand_off(next)
+	} else {
+		//tombstones stay until they're collected, so a value this node
+		//never heard was deleted can't come back through it
+		drop_values()
+	}
+	current.Nodes = nil
 	current.Shard = 0
-	ticker.Stop()
+	//remember the epoch so gossip about the old view doesn't add us back
+	if newer_view(next, current) {
+		current.Epoch = next.Epoch
+		current.RequestID = next.RequestID
+		current.HLC = next.HLC
+	}
+	viewMu.Unlock()
+	//the gossip keeps ticking, it does nothing while we're out of the
+	//view and picks up again if the node gets added back
 	//fmt.Println("STOPPED")
 	w.WriteHeader(200)
 }
@@ -637,175 +859,121 @@ func testEq(a, b []string) bool {
 	return true
 }
 
-// gossips to other nodes about what KVS it has
-func gossip_kvs(v []KVS) {
-	if !inView {
-		return
-	}
-	client := http.Client{
-		Timeout: time.Second * 1,
-	}
-
-	//should change this to just target a random node for less traffic
-
-	//gossip the kvs
-	for i := 0; i < len(current.Nodes); i++ {
-		if current.Nodes[i] == os.Getenv("ADDRESS") {
-			continue
-		}
-		//only gossip to other nodes in the same shard as you
-		if i%current.Shard == selfID {
-			url := "http://" + current.Nodes[i] + "/gossip"
-			view_marshalled, _ := json.Marshal(keys)
-			r, err := http.NewRequest("PUT", url, strings.NewReader(string(view_marshalled)))
-			if err != nil {
-				//fmt.Println("ERROR IN GOSSIP KVS")
-				continue
-			}
-			r.Header.Add("Content-Type", "application/json")
-			client.Do(r)
-		}
-	}
-}
-
 // creates the kvs
 func create_kvs(w http.ResponseWriter, r *http.Request) {
-	if !inView {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(418)
-		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
-		return
-	}
-	//fmt.Println("we've entered create_kvs")
-
-	w.Header().Set("Content-Type", "application/json")
-
 	//gets the JSON body
-	vars := mux.Vars(r)
-	k := vars["key"]
-	var key KVS
+	var key DataRequest
 	_ = json.NewDecoder(r.Body).Decode(&key)
+	put_key(r.Context(), mux.Vars(r)["key"], key).write(w)
+}
+
+// writes a key for a client, whether it came in on its own or in a batch
+func put_key(rctx context.Context, k string, key DataRequest) dataResult {
+	v := load_view()
+	if !v.inView {
+		return answer_with(418, map[string]string{"error": "uninitialized"})
+	}
+	//fmt.Println("we've entered create_kvs")
 
 	if key.Vector == nil {
-		key.Vector = vclock.New()
+		key.Vector = CausalContext{}
 	}
 
 	//checks if JSON is malformed
 	if k == "" {
-		w.WriteHeader(400)
-		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
-		return
+		return answer_with(400, map[string]string{"error": "bad request"})
 	}
 
 	//check if key or value is longer than 200 characters
 	if len(k) > 2048 || len(key.Value) > 8000000 {
-		w.WriteHeader(400)
-		json.NewEncoder(w).Encode(map[string]string{"error": "key/val too large"})
-		return
+		return answer_with(400, map[string]string{"error": "key/val too large"})
+	}
+	if key.TTL < 0 {
+		return answer_with(400, map[string]string{"error": "bad ttl"})
 	}
 
-	hashed_key := hash(k) //% uint64(current.Shard)
-	hash_key_64 := int64(hashed_key)
-	bucketNumber := jump_hash(hash_key_64, len(current.Nodes))
-	if current.Shard == 0 {
-		w.WriteHeader(400)
-		json.NewEncoder(w).Encode(map[string]string{"error": "divide by 0"})
-		return
+	level, ok := consistency_level(key.Consistency, writeConsistency)
+	if !ok {
+		return answer_with(400, map[string]string{"error": "bad consistency level"})
+	}
+
+	if v.current.Shard == 0 {
+		return answer_with(400, map[string]string{"error": "divide by 0"})
 	}
-	targetShard := bucketNumber % current.Shard
-	//f("target shard: %#v\n myShard: %#v\n", targetShard, selfID)
+	targetShard := shard_of(k, v.current)
+	//f("target shard: %#v\n myShard: %#v\n", targetShard, v.selfID)
 	//set_shardView()
 	//if this current node is not in the same shard as the designated bucket,
 	//then proxy the request to a node that is in the same shard as the bucket.
 
-	//designatedIndex refers to the index within our getView that has the shard.
+	//designatedIndex refers to the index within our v.shards that has the shard.
 	designatedIndex := 0
 
-	for j := 0; j < len(getView); j++ {
-		if getView[j].Shard == targetShard {
+	for j := 0; j < len(v.shards); j++ {
+		if v.shards[j].Shard == targetShard {
 			designatedIndex = j
 		}
 	}
-	//fmt.Printf("GETVIEW: %v\n", (getView))
+	//fmt.Printf("GETVIEW: %v\n", (v.shards))
 	//fmt.Printf("INDEX: %v\n", (designatedIndex))
-	//fmt.Printf("VIEW: %v\n", getView[designatedIndex].Node)
-	if targetShard != selfID {
-		vector := make(chan vclock.VClock)
-		for _, eachAddress := range getView[designatedIndex].Node {
-			go func(address string, vector chan vclock.VClock) {
-				client := http.Client{
-					Timeout: time.Second * 20,
-				}
-				view_marshalled, _ := json.Marshal(key)
-				r, _ := http.NewRequest("PUT", "http://"+address+"/kvs/data/"+k, strings.NewReader(string(view_marshalled)))
-				r.Header.Add("Content-Type", "application/json")
-				response, err := client.Do(r)
-				if err != nil {
-					return
-				}
-				res := KVS{}
-				json.NewDecoder(response.Body).Decode(&res)
-				response.Body.Close()
-				vector <- res.Vector
-			}(eachAddress, vector)
-
-		}
-
-		select {
-		case res := <-vector:
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Version vclock.VClock `json:"causal-metadata"`
-			}{res})
-		case <-time.After(20 * time.Second):
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(503)
-			json.NewEncoder(w).Encode(struct {
-				Error    string     `json:"error"`
-				Upstream NodeShards `json:"upstream"`
-			}{"upstream down", getView[designatedIndex]})
-		}
-		return
+	//fmt.Printf("VIEW: %v\n", v.shards[designatedIndex].Node)
+	if targetShard != v.selfID {
+		return relay("PUT", "/kvs/data/"+k, key, v.shards[designatedIndex])
+	}
+	//linearizable keys go through the shard's raft log instead
+	if linearizable(k) {
+		return raft_write(rctx, raftCommand{Op: "put", Key: k, Value: key.Value, Vector: key.Vector.for_shard(v), If: key.Condition.command(), TTL: key.TTL}, key.Vector)
+	}
+	if res, ok := forward_conditional("PUT", k, key, v); ok {
+		return res
+	}
+	if res, ok := txn_guard("PUT", "/kvs/data/"+k, k, key, v); ok {
+		return res
 	}
-
-	//right now this is just sending to a specific bucket number (aka index on the address list),
-	//but we need to consider the case when this bucket is down.
-	//In that case, we should send it to another node that is in the same shard as the bucket!
 
 	//checks if it's in memory, if so replace it
-	for index, item := range keys {
-		if item.Key == k && item.Value != "" {
-			item.Value = key.Value
-			item.Vector.Merge(key.Vector)
-			item.Vector.Tick(item.Key)
-			item.Version, _ = item.Vector.FindTicks(item.Key)
-			item.Time = time.Now()
-			keys = append(keys[:index], keys[index+1:]...)
-			keys = append(keys, item)
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(struct {
-				Version vclock.VClock `json:"causal-metadata"`
-			}{item.Vector})
-			return
+	failed, existed := false, false
+	var written vclock.VClock
+	dot := dots.next()
+	defer dots.done(dot)
+	item, err := store.Update(k, func(item KVS, found bool) (KVS, bool) {
+		now := time.Now()
+		if !key.Condition.holds(item, found, now) {
+			failed, existed = true, found
+			return item, false
 		}
+		next := put_item(item, found, k, key.Value, key.Vector.for_shard(v), dot, now)
+		next.Expires = expiry(key.TTL, now)
+		if siblings_for(k) {
+			written = add_sibling(&next, siblings_of(item, found), key.Value, key.Context, next.Time)
+		}
+		return next, true
+	})
+	if err != nil {
+		return storage_failure(err)
+	}
+	if failed {
+		return precondition_failed(item, existed)
 	}
-	//fmt.Println("we've passed flag2")
 
-	//if it's a new key
-	//make new clock and tick it
-	key.Key = k
-	key.Vector.Tick(key.Key)
-	key.Version, _ = key.Vector.FindTicks(key.Key)
-	key.Time = time.Now()
-	keys = append(keys, key)
-	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(struct {
-		Version vclock.VClock `json:"causal-metadata"`
-	}{key.Vector})
+	//this node is the coordinator, get the write onto enough of the shard
+	peers := shard_peers(v)
+	need := required(level, len(peers)+1)
+	if acks := replicate(item, peers, need); acks < need {
+		return quorum_failure(acks, need)
+	}
+	ctx := key.Vector.with(v.selfID, item.Vector)
+	if siblings_for(k) {
+		return sibling_written(item, written, ctx)
+	}
+	return answer_with(200, struct {
+		Clock   vclock.VClock `json:"clock"`
+		Version CausalContext `json:"causal-metadata"`
+	}{item.Vector, ctx})
 }
 
 func putNoCausal(w http.ResponseWriter, r *http.Request) {
-	if !inView {
+	if !load_view().inView {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(418)
 		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
@@ -823,17 +991,30 @@ func putNoCausal(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//checks if it's in memory, if so replace it
-	for _, item := range keys {
-		if item.Key == key.Key && item.Value != "" {
-			w.WriteHeader(200)
-			return
+	added := false
+	_, err := store.Update(key.Key, func(item KVS, found bool) (KVS, bool) {
+		//a delete it hasn't seen keeps it out
+		if found && (!item.Deleted || keep_local(item, key)) {
+			return item, false
 		}
+		if !found && tombstones.covers(key.Key, key.Vector) {
+			return item, false
+		}
+		//fmt.Println("we've passed flag2")
+
+		//if it's a new key
+		//make new clock and tick it
+		added = true
+		return key, true
+	})
+	if err != nil {
+		storage_error(w, err)
+		return
+	}
+	if !added {
+		w.WriteHeader(200)
+		return
 	}
-	//fmt.Println("we've passed flag2")
-
-	//if it's a new key
-	//make new clock and tick it
-	keys = append(keys, key)
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(struct {
 		Version vclock.VClock `json:"causal-metadata"`
@@ -844,40 +1025,129 @@ func putNoCausal(w http.ResponseWriter, r *http.Request) {
 func compare_kvs(w http.ResponseWriter, r *http.Request) {
 	var k []KVS
 	_ = json.NewDecoder(r.Body).Decode(&k)
-	//if current node KVS is empty
-	if len(keys) == 0 {
-		keys = k
-		return
+	merge_keys(k)
+}
+
+// compare both and update KVS, keys we don't have just get slotted in
+func merge_keys(k []KVS) {
+	view := load_view()
+	for _, sent := range k {
+		//keys that moved to another shard are up to the rebalancer,
+		//don't let gossip drag them back in
+		if view.inView && shard_of(sent.Key, view.current) != view.selfID {
+			continue
+		}
+		//linearizable keys only change through the log, which
+		//already gets them to every replica
+		if linearizable(sent.Key) {
+			continue
+		}
+		merge_replica(sent)
 	}
+}
 
-	//compare both and update KVS
-	mergedMap := make(map[string]KVS)
-	mergedKeys := []KVS{}
+// if they are the same write || local key has seen the sent one and not the other way around ||
+// neither has seen the other (or both the same writes) and local key was written later
+func keep_local(local KVS, sent KVS) bool {
+	if same_kvs(local, sent) {
+		return true
+	}
+	seen, overwritten := descends(local.Vector, sent.Vector), descends(sent.Vector, local.Vector)
+	if seen != overwritten {
+		return seen
+	}
+	return written_before(sent, local)
+}
 
-	//slot in recieved key
-	for _, key := range k {
-		mergedMap[key.Key] = key
+// the newer of two versions with both their clocks in it, for values
+// that get merged instead of one replacing the other
+func merge_meta(a KVS, b KVS) KVS {
+	out := a
+	if !keep_local(a, b) {
+		out = b
+	}
+	out.Vector = a.Vector.Copy()
+	out.Vector.Merge(b.Vector)
+	if b.Version > out.Version {
+		out.Version = b.Version
 	}
+	if a.Version > out.Version {
+		out.Version = a.Version
+	}
+	if b.Time.After(out.Time) {
+		out.Time = b.Time
+	}
+	if a.Time.After(out.Time) {
+		out.Time = a.Time
+	}
+	if out.HLC.before(b.HLC) {
+		out.HLC = b.HLC
+	}
+	if out.HLC.before(a.HLC) {
+		out.HLC = a.HLC
+	}
+	return out
+}
 
-	//if key is not in the local kvs || local key is concurrent to sent key and sent key was written later || sent key is descendent of local key
-	for _, key := range keys {
-		if p, ok := mergedMap[key.Key]; !ok || (p.Version == key.Version && key.Vector.Compare(p.Vector, vclock.Concurrent) && key.Time.After(p.Time)) || key.Version > p.Version {
-			mergedMap[key.Key] = key
-		}
+// the new version of a key after a client that has seen the writes in
+// seen (its causal metadata for the key's shard) writes value to it as dot
+func put_item(item KVS, found bool, k string, value string, seen vclock.VClock, dot Dot, now time.Time) KVS {
+	if found && !item.Deleted {
+		item.Value = value
+		//a plain write replaces whatever CRDT was there
+		item.CRDT = nil
+		//and the expiry, the writer sets a new one
+		item.Expires = nil
+		item.Vector = item.Vector.Copy()
+		item.Vector.Merge(seen)
+		item.Vector = with_dot(item.Vector, dot)
+		item.Dot = dot
+		item.Version += 1
+		item.Time = now
+		item.HLC = clock.at(now)
+		return item
 	}
+	//fmt.Println("we've passed flag2")
 
-	//reform the array
-	for _, key := range mergedMap {
-		mergedKeys = append(mergedKeys, key)
+	//if it's a new key
+	//make new clock with the dot in it, past the delete if there was one
+	old := item
+	item = KVS{Key: k, Value: value}
+	if found {
+		item.Vector, item.Version = old.Vector.Copy(), old.Version
+	} else {
+		item.Vector, item.Version = tombstones.clock_of(k)
+	}
+	if item.Vector == nil {
+		item.Vector = vclock.New()
 	}
+	item.Vector.Merge(seen)
+	item.Vector = with_dot(item.Vector, dot)
+	item.Dot = dot
+	item.Version += 1
+	item.Time = now
+	item.HLC = clock.at(now)
+	return item
+}
 
-	//set the array
-	keys = mergedKeys
+// the tombstone a delete as dot leaves behind
+func delete_item(item KVS, dot Dot, now time.Time) KVS {
+	item.Value = ""
+	item.Deleted = true
+	item.CRDT = nil
+	item.Expires = nil
+	item.Version += 1
+	//add the dot to the clock
+	item.Vector = with_dot(item.Vector, dot)
+	item.Dot = dot
+	item.Time = now
+	item.HLC = clock.at(now)
+	return item
 }
 
 // gossips about the view to other nodes
 func gossip_view(v Shards) {
-	if !inView {
+	if !load_view().inView {
 		return
 	}
 
@@ -886,66 +1156,126 @@ func gossip_view(v Shards) {
 	}
 
 	//should change this to just target a random node for less traffic
-	for i := 0; i < len(current.Nodes); i += 1 {
-		if current.Nodes[i] == os.Getenv("ADDRESS") {
+	for i := 0; i < len(v.Nodes); i += 1 {
+		if v.Nodes[i] == os.Getenv("ADDRESS") {
 			continue
 		}
-		url := "http://" + current.Nodes[i] + "/gossip/view"
-		view_marshalled, _ := json.Marshal(Shards{Shard: current.Shard, Nodes: current.Nodes, Time: current.Time})
+		url := "http://" + v.Nodes[i] + "/gossip/view"
+		view_marshalled, _ := json.Marshal(Shards{Shard: v.Shard, Nodes: v.Nodes, Epoch: v.Epoch, RequestID: v.RequestID, Keyspaces: v.Keyspaces, HLC: v.HLC, Groups: v.Groups})
 		//r, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData)) ------------
 		r, err := http.NewRequest("PUT", url, strings.NewReader(string(view_marshalled)))
 		if err != nil {
 			continue
 		}
 		r.Header.Add("Content-Type", "application/json")
+		with_clock(r)
 		client.Do(r)
 	}
 }
 
+// reports a failed write to the storage engine
+func storage_error(w http.ResponseWriter, err error) {
+	storage_failure(err).write(w)
+}
+
+func storage_failure(err error) dataResult {
+	fmt.Printf("storage: %v\n", err)
+	return answer_with(500, map[string]string{"error": "storage failure"})
+}
+
+// checks if two versions of a key are the same write
+func same_kvs(a, b KVS) bool {
+	return a.Key == b.Key && a.Value == b.Value && a.Deleted == b.Deleted && a.Version == b.Version &&
+		a.Dot == b.Dot && a.Time.Equal(b.Time) && a.HLC == b.HLC && a.Vector.Compare(b.Vector, vclock.Equal) &&
+		same_siblings(a.Siblings, b.Siblings) && same_crdt(a.CRDT, b.CRDT) &&
+		same_expiry(a.Expires, b.Expires)
+}
+
 func hash(s string) uint64 {
 	hasher := fnv.New64a()
 	hasher.Write([]byte(s))
 	return hasher.Sum64()
 }
 
-func jump_hash(key int64, buckets int) int {
-	rand.Seed(key)
-	var tracker1 float64
-	var tracker2 float64
-	tracker1 = 1.0
-	tracker2 = 0.0
-	for tracker2 < float64(buckets) {
-		tracker1 = tracker2
-		tracker2 = ((tracker1 + 1) / rand.Float64())
+// which shard the key lives on in the given view
+func shard_of(key string, view Shards) int {
+	if ks := partition.FindKeyspace(view.Keyspaces, key); ks != nil {
+		return ks.Shard(key, view.Shard)
 	}
-	return int(tracker1)
+	return partitioner_for(view.Shard).Shard(key)
 }
 
-// currently doesn't really look at causal consistency yet;
-// but it can be used to make sure all the keys are in the right shards!
+// how keys and nodes get spread over the shards, has to be the same on
+// every node. Set by PARTITIONER ("ring" or "jump"), VNODES and PLACEMENT
+// ("roundrobin" or "contiguous")
+var partitionerKind = partition.KindRing
+var vnodes = partition.DefaultVNodes
+var placement = partition.PlacementRoundRobin
+
+// building a ring isn't free, so keep one per shard count
+var partitioners = make(map[int]partition.Partitioner)
+var partitionersMu sync.Mutex
+
+func load_partitioning() error {
+	if kind := os.Getenv("PARTITIONER"); kind != "" {
+		partitionerKind = kind
+	}
+	vnodes = env_int("VNODES", vnodes)
+	if p := os.Getenv("PLACEMENT"); p != "" {
+		placement = p
+	}
+	//try them out so a typo fails at boot and not on the first request
+	if _, err := partition.New(partitionerKind, 1, vnodes); err != nil {
+		return err
+	}
+	_, err := partition.Assign(nil, nil, 1, placement)
+	return err
+}
+
+func partitioner_for(shards int) partition.Partitioner {
+	if shards <= 0 {
+		shards = 1
+	}
+	partitionersMu.Lock()
+	defer partitionersMu.Unlock()
+	if p, ok := partitioners[shards]; ok {
+		return p
+	}
+	p, _ := partition.New(partitionerKind, shards, vnodes)
+	partitioners[shards] = p
+	return p
+}
+
+// lists the keys of this node's shard, the causal metadata covers
+// everything the node knows of the shard so it stays the size of the shard
+// and not of the keyspace.
+// it can be used to make sure all the keys are in the right shards!
 func get_all_keys(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	if !check_epoch(w, r, v) {
+		return
+	}
 
+	//taken before the listing so it doesn't claim more than the keys show
+	known := causal.snapshot()
 	var keyList []string
 	count := 0
-	vectorCombined := vclock.New()
-	for _, item := range keys {
-		if item.Value != "" {
+	now := time.Now()
+	store.Range(func(item KVS) bool {
+		if present(item, true, now) {
 			keyList = append(keyList, item.Key)
 			count = count + 1
 		}
-		//are we including the causal metadata of deleted keys?
-		vectorCombined.Merge(item.Vector)
-		//increment vector here for reads if needed
-
-	}
+		return true
+	})
 
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(struct {
 		Shard   int           `json:"shard_id"`
 		Count   int           `json:"count"`
 		Keys    []string      `json:"keys"`
-		Version vclock.VClock `json:"causal-metadata"`
-	}{selfID, count, keyList, vectorCombined})
+		Version CausalContext `json:"causal-metadata"`
+	}{v.selfID, count, keyList, CausalContext{v.selfID: known}})
 
 }
 
@@ -953,14 +1283,14 @@ func get_all_keys(w http.ResponseWriter, r *http.Request) {
 func start_gossip() {
 	//do this every second
 	interal := 1
-	ticker = *time.NewTicker(time.Duration(interal) * time.Second)
+	ticker = time.NewTicker(time.Duration(interal) * time.Second)
 
 	//sends info about view/KVS to the other nodes in the background
 	go func() {
 		for {
 			<-ticker.C
-			go gossip_view(current)
-			go gossip_kvs(keys)
+			go gossip_view(load_view().current)
+			go gossip_kvs()
 			//go test(current)
 		}
 	}()
@@ -969,14 +1299,77 @@ func start_gossip() {
 func main() {
 	router := mux.NewRouter()
 	inView = false
+	var err error
+	if err = load_partitioning(); err != nil {
+		fmt.Printf("bad partitioning config: %v\n", err)
+		os.Exit(1)
+	}
+	engine, err = open_engine()
+	if err != nil {
+		fmt.Printf("could not open storage: %v\n", err)
+		os.Exit(1)
+	}
+	//the merkle tree leaves linearizable keys out, so it needs
+	//the prefixes before the keys come back
+	load_raft()
+	//bring back the keys and the view before answering anything
+	restore_state()
+	load_dots()
+	causalTimeout = env_duration("CAUSAL_TIMEOUT", time.Second, causalTimeout)
+	load_consistency()
+	load_membership()
+	load_rebalance()
+	load_siblings()
+	load_txns()
+	load_ranges()
+	load_ttl()
+	load_tombstones()
+	load_clock()
+	start_snapshots()
 	start_gossip()
+	start_membership()
+	start_rebalancer()
+	start_raft()
+	start_txns()
+	start_ranges()
+	start_watches()
+	start_ttl()
+	start_tombstones()
 	router.HandleFunc("/kvs/data", get_all_keys).Methods("GET")
 	router.HandleFunc("/gossip/view", compare_view).Methods("PUT")
 	router.HandleFunc("/gossip", compare_kvs).Methods("PUT")
+	router.HandleFunc("/gossip/merkle", merkle_hashes).Methods("PUT")
+	router.HandleFunc("/gossip/leaves", merkle_leaves).Methods("PUT")
+	router.HandleFunc("/gossip/stable", stable_tombstones).Methods("PUT")
+	router.HandleFunc("/gossip/moving", moving_keys).Methods("GET")
 	router.HandleFunc("/putNo", putNoCausal).Methods("PUT")
+	router.HandleFunc("/replica/{key}", handle_replica).Methods("GET", "PUT")
+	router.HandleFunc("/rebalance", rebalance_batch).Methods("PUT")
+	router.HandleFunc("/batch/shard", batch_shard).Methods("PUT")
+	router.HandleFunc("/list/shard", list_shard).Methods("GET")
+	router.HandleFunc("/txn/prepare", txn_prepare).Methods("PUT")
+	router.HandleFunc("/txn/{op:commit|abort}", txn_decide).Methods("PUT")
+	router.HandleFunc("/txn/{op:lock|unlock}", txn_hint).Methods("PUT")
+	router.HandleFunc("/txn/status/{id}", txn_status).Methods("GET")
+	router.HandleFunc("/raft/vote", raft_vote).Methods("PUT")
+	router.HandleFunc("/raft/append", raft_append).Methods("PUT")
+	router.HandleFunc("/raft/snapshot", raft_snapshot).Methods("PUT")
+	router.HandleFunc("/raft/propose", raft_propose).Methods("PUT")
+	router.HandleFunc("/swim/ping", swim_ping).Methods("PUT")
+	router.HandleFunc("/swim/ping-req", swim_ping_req).Methods("PUT")
+	router.HandleFunc("/kvs/admin/rebalance", get_rebalance).Methods("GET")
+	router.HandleFunc("/kvs/admin/clock", get_clock).Methods("GET")
+	router.HandleFunc("/kvs/admin/keyspace", create_keyspace).Methods("PUT")
 	router.HandleFunc("/kvs/admin/view", handle_kvs_view).Methods("GET", "PUT", "DELETE")
 	router.HandleFunc("/kvs/data/{key}", handle_kvs).Methods("GET", "PUT", "DELETE")
-
+	router.HandleFunc("/kvs/data/{key}/{op}", crdt_op).Methods("POST")
+	router.HandleFunc("/kvs/txn", kvs_txn).Methods("POST")
+	router.HandleFunc("/kvs/batch", kvs_batch).Methods("POST")
+	router.HandleFunc("/kvs/keys", list_keys).Methods("GET")
+	router.HandleFunc("/kvs/scan", scan_keys).Methods("GET")
+	router.HandleFunc("/kvs/watch", watch_keys).Methods("GET")
+
+	router.Use(observe_clock)
 	http.ListenAndServe(":8080", router)
 
 }
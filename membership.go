@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SWIM style failure detection. Every protocol period a node pings one
+// other member, if that fails it asks a few others to ping it for it,
+// and if nobody gets an answer the member becomes suspect. A suspect
+// that doesn't refute it (by bumping its incarnation) within the
+// suspicion timeout is declared dead. Changes ride along on the pings.
+const (
+	StateAlive   = "alive"
+	StateSuspect = "suspect"
+	StateDead    = "dead"
+)
+
+// what one node thinks about another
+type Member struct {
+	Address     string `json:"address"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// a membership change that still has to be gossiped
+type memberUpdate struct {
+	member Member
+	sent   int
+}
+
+// the body of a ping, and of its ack
+type pingMessage struct {
+	From    string   `json:"from"`
+	Updates []Member `json:"updates"`
+}
+
+// asks a node to ping target for us
+type pingReqMessage struct {
+	From    string   `json:"from"`
+	Target  string   `json:"target"`
+	Updates []Member `json:"updates"`
+}
+
+type pingReqAnswer struct {
+	Ack     bool     `json:"ack"`
+	Updates []Member `json:"updates"`
+}
+
+type membership struct {
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	//when each suspect became suspect
+	suspected map[string]time.Time
+	updates   []*memberUpdate
+	//round robin order for picking who to ping
+	order []string
+	next  int
+	//its own source so probing order doesn't depend on anyone else
+	rng *rand.Rand
+}
+
+// knobs, set by PROTOCOL_PERIOD and PING_TIMEOUT (milliseconds),
+// SUSPECT_TIMEOUT (seconds) and INDIRECT_PINGS
+var protocolPeriod = time.Second
+var pingTimeout = 300 * time.Millisecond
+var suspectTimeout = 5 * time.Second
+var indirectPings = 3
+
+// how many updates go out with each ping
+const maxPiggyback = 8
+
+var swim = &membership{
+	members:   make(map[string]*Member),
+	suspected: make(map[string]time.Time),
+	rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+func load_membership() {
+	protocolPeriod = env_duration("PROTOCOL_PERIOD", time.Millisecond, protocolPeriod)
+	pingTimeout = env_duration("PING_TIMEOUT", time.Millisecond, pingTimeout)
+	suspectTimeout = env_duration("SUSPECT_TIMEOUT", time.Second, suspectTimeout)
+	indirectPings = env_int("INDIRECT_PINGS", indirectPings)
+}
+
+// adds the nodes that joined the view and forgets the ones that left
+func (m *membership) sync(nodes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	self := os.Getenv("ADDRESS")
+	inView := make(map[string]bool)
+	for _, node := range nodes {
+		if node == self {
+			continue
+		}
+		inView[node] = true
+		if _, ok := m.members[node]; !ok {
+			m.members[node] = &Member{Address: node, State: StateAlive}
+		}
+	}
+	for node := range m.members {
+		if !inView[node] {
+			delete(m.members, node)
+			delete(m.suspected, node)
+		}
+	}
+}
+
+// applies a change heard from another node, the usual SWIM rules:
+// a higher incarnation always wins, on the same incarnation
+// dead beats suspect and suspect beats alive
+func (m *membership) apply(u Member) {
+	self := os.Getenv("ADDRESS")
+	if u.Address == self {
+		//someone thinks we're down, refute it
+		if u.State != StateAlive && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			m.queue(Member{self, StateAlive, m.incarnation})
+		}
+		return
+	}
+	cur, ok := m.members[u.Address]
+	if !ok {
+		//not in our view
+		return
+	}
+	newer := u.Incarnation > cur.Incarnation ||
+		(u.Incarnation == cur.Incarnation && state_rank(u.State) > state_rank(cur.State))
+	if !newer {
+		return
+	}
+	cur.State = u.State
+	cur.Incarnation = u.Incarnation
+	if u.State == StateSuspect {
+		m.suspected[u.Address] = time.Now()
+	} else {
+		delete(m.suspected, u.Address)
+	}
+	m.queue(*cur)
+}
+
+func state_rank(state string) int {
+	switch state {
+	case StateSuspect:
+		return 1
+	case StateDead:
+		return 2
+	}
+	return 0
+}
+
+// queues a change to be piggybacked, replacing older news about the same node
+func (m *membership) queue(u Member) {
+	for i, old := range m.updates {
+		if old.member.Address == u.Address {
+			m.updates = append(m.updates[:i], m.updates[i+1:]...)
+			break
+		}
+	}
+	m.updates = append(m.updates, &memberUpdate{member: u})
+}
+
+// takes the updates that go out with the next message. Each one is sent
+// about 3*log(n) times, enough for it to reach everyone with high probability
+func (m *membership) piggyback() []Member {
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	out := []Member{}
+	kept := m.updates[:0]
+	for _, u := range m.updates {
+		if len(out) < maxPiggyback {
+			out = append(out, u.member)
+			u.sent++
+		}
+		if u.sent < limit {
+			kept = append(kept, u)
+		}
+	}
+	m.updates = kept
+	return out
+}
+
+func (m *membership) receive(updates []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range updates {
+		m.apply(u)
+	}
+}
+
+func (m *membership) outgoing() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.piggyback()
+}
+
+// the state this node has for another one, unknown nodes count as alive
+func (m *membership) state_of(address string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.members[address]; ok {
+		return cur.State
+	}
+	return StateAlive
+}
+
+// everyone this node knows about, itself included
+func (m *membership) list() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Member{{os.Getenv("ADDRESS"), StateAlive, m.incarnation}}
+	for _, cur := range m.members {
+		out = append(out, *cur)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// drops the known-dead nodes and puts the suspects after the alive ones
+func live_first(nodes []string) []string {
+	alive := []string{}
+	suspect := []string{}
+	for _, node := range nodes {
+		switch swim.state_of(node) {
+		case StateAlive:
+			alive = append(alive, node)
+		case StateSuspect:
+			suspect = append(suspect, node)
+		}
+	}
+	return append(alive, suspect...)
+}
+
+// picks the next member to probe, going round robin over a shuffled list
+func (m *membership) pick() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.next >= len(m.order) {
+		m.order = m.order[:0]
+		for node := range m.members {
+			m.order = append(m.order, node)
+		}
+		sort.Strings(m.order)
+		m.rng.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	for m.next < len(m.order) {
+		node := m.order[m.next]
+		m.next++
+		if _, ok := m.members[node]; ok {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// up to k random members other than target that aren't known to be dead
+func (m *membership) helpers(target string, k int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	candidates := []string{}
+	for node, cur := range m.members {
+		if node != target && cur.State != StateDead {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.Strings(candidates)
+	m.rng.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// marks a member suspect after a failed probe
+func (m *membership) suspect(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.members[address]
+	if !ok || cur.State != StateAlive {
+		return
+	}
+	m.apply(Member{address, StateSuspect, cur.Incarnation})
+}
+
+// marks a member alive after it answered, unless someone already
+// knows better about a newer incarnation
+func (m *membership) alive(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.members[address]
+	if !ok || cur.State == StateAlive {
+		return
+	}
+	//it answered us, so whatever we suspected is stale. It will refute
+	//properly once it hears about it, until then just stop suspecting
+	if cur.State == StateSuspect {
+		cur.State = StateAlive
+		delete(m.suspected, address)
+		return
+	}
+	//a dead node is back, tell it so it can bump its incarnation
+	m.queue(*cur)
+}
+
+// a node we think is down just talked to us, make sure the answer
+// tells it what we think so it can refute it
+func (m *membership) heard_from(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.members[address]; ok && cur.State != StateAlive {
+		m.queue(*cur)
+	}
+}
+
+// declares the suspects that have been suspect for too long dead
+func (m *membership) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for address, since := range m.suspected {
+		if time.Since(since) < suspectTimeout {
+			continue
+		}
+		if cur, ok := m.members[address]; ok && cur.State == StateSuspect {
+			m.apply(Member{address, StateDead, cur.Incarnation})
+		}
+		delete(m.suspected, address)
+	}
+}
+
+// sends one ping and takes in whatever news came back
+func ping(address string, timeout time.Duration) bool {
+	client := http.Client{
+		Timeout: timeout,
+	}
+	var ack pingMessage
+	if !put_json(&client, "http://"+address+"/swim/ping", pingMessage{os.Getenv("ADDRESS"), swim.outgoing()}, &ack) {
+		return false
+	}
+	swim.receive(ack.Updates)
+	return true
+}
+
+// one protocol period: probe a member directly, then indirectly
+func (m *membership) probe() {
+	m.expire()
+	target, ok := m.pick()
+	if !ok {
+		return
+	}
+	if ping(target, pingTimeout) {
+		m.alive(target)
+		return
+	}
+
+	helpers := m.helpers(target, indirectPings)
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			client := http.Client{
+				Timeout: protocolPeriod,
+			}
+			var answer pingReqAnswer
+			req := pingReqMessage{os.Getenv("ADDRESS"), target, m.outgoing()}
+			if !put_json(&client, "http://"+helper+"/swim/ping-req", req, &answer) {
+				acks <- false
+				return
+			}
+			m.receive(answer.Updates)
+			acks <- answer.Ack
+		}(helper)
+	}
+	deadline := time.NewTimer(protocolPeriod)
+	defer deadline.Stop()
+	for range helpers {
+		select {
+		case ack := <-acks:
+			if ack {
+				m.alive(target)
+				return
+			}
+		case <-deadline.C:
+			m.suspect(target)
+			return
+		}
+	}
+	m.suspect(target)
+}
+
+// answers a direct ping
+func swim_ping(w http.ResponseWriter, r *http.Request) {
+	var msg pingMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	swim.receive(msg.Updates)
+	swim.heard_from(msg.From)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(pingMessage{os.Getenv("ADDRESS"), swim.outgoing()})
+}
+
+// pings the target for another node that couldn't reach it
+func swim_ping_req(w http.ResponseWriter, r *http.Request) {
+	var msg pingReqMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	swim.receive(msg.Updates)
+	swim.heard_from(msg.From)
+	ack := ping(msg.Target, pingTimeout)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(pingReqAnswer{ack, swim.outgoing()})
+}
+
+// runs the failure detector in the background
+func start_membership() {
+	go func() {
+		for {
+			time.Sleep(protocolPeriod)
+			v := load_view()
+			if !v.inView {
+				continue
+			}
+			swim.sync(v.current.Nodes)
+			swim.probe()
+		}
+	}()
+}
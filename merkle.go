@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// The anti-entropy gossip compares merkle trees instead of shipping
+// every key. The hash space is cut into 2^merkleDepth ranges, each leaf
+// holds the XOR of the digests of the keys in its range, and every inner
+// node hashes its two children. Two replicas walk down from the root and
+// only swap the keys of the leaves that ended up different. The root's
+// answer also says how far the replica had every write when the walk
+// started, which the other side has too once it took the differing keys.
+const merkleDepth = 10
+const merkleLeaves = 1 << merkleDepth
+
+type MerkleTree struct {
+	mu     sync.Mutex
+	leaves [merkleLeaves]uint64
+	keys   [merkleLeaves]map[string]struct{}
+}
+
+func new_merkle() *MerkleTree {
+	t := &MerkleTree{}
+	for i := range t.keys {
+		t.keys[i] = make(map[string]struct{})
+	}
+	return t
+}
+
+// which leaf a key falls into, the top bits of its hash
+func leaf_of(key string) int {
+	return int(hash(key) >> (64 - merkleDepth))
+}
+
+func write_hlc(hasher io.Writer, stamp HLC) {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(stamp.Wall))
+	binary.BigEndian.PutUint32(buf[8:], stamp.Logical)
+	hasher.Write(buf[:])
+	hasher.Write([]byte(stamp.Node))
+	hasher.Write([]byte{0})
+}
+
+// hashes everything about a version of a key that replicas have to agree on
+func digest(k KVS) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(k.Key))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(k.Value))
+	hasher.Write([]byte{0})
+	if k.Deleted {
+		hasher.Write([]byte{1})
+	}
+	hasher.Write([]byte(k.Vector.ReturnVCString()))
+	hasher.Write([]byte(k.Dot.Node))
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], k.Dot.Counter)
+	hasher.Write(buf[:8])
+	binary.BigEndian.PutUint64(buf[:8], k.Version)
+	binary.BigEndian.PutUint64(buf[8:], uint64(k.Time.UnixNano()))
+	hasher.Write(buf[:])
+	write_hlc(hasher, k.HLC)
+	for _, s := range k.Siblings {
+		hasher.Write([]byte(s.Value))
+		hasher.Write([]byte{0})
+		if s.Deleted {
+			hasher.Write([]byte{1})
+		}
+		hasher.Write([]byte(s.Clock.ReturnVCString()))
+		binary.BigEndian.PutUint64(buf[:8], uint64(s.Time.UnixNano()))
+		hasher.Write(buf[:8])
+		write_hlc(hasher, s.HLC)
+	}
+	if k.CRDT != nil {
+		state, _ := json.Marshal(k.CRDT)
+		hasher.Write(state)
+	}
+	if k.Expires != nil {
+		binary.BigEndian.PutUint64(buf[:8], uint64(k.Expires.UnixNano()))
+		hasher.Write(buf[:8])
+	}
+	return hasher.Sum64()
+}
+
+// swaps the old version of a key for the new one in its leaf,
+// pass found false for a key that wasn't there / is gone now.
+// Linearizable keys are left out, raft keeps those in sync and a
+// follower that's a few entries behind shouldn't look out of date
+func (t *MerkleTree) update(key string, old KVS, hadOld bool, next KVS, hasNext bool) {
+	if linearizable(key) {
+		return
+	}
+	leaf := leaf_of(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if hadOld {
+		t.leaves[leaf] ^= digest(old)
+	}
+	if hasNext {
+		t.leaves[leaf] ^= digest(next)
+		t.keys[leaf][key] = struct{}{}
+	} else {
+		delete(t.keys[leaf], key)
+	}
+}
+
+func (t *MerkleTree) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.leaves {
+		t.leaves[i] = 0
+		t.keys[i] = make(map[string]struct{})
+	}
+}
+
+// every level of the tree, levels[0] is the root and levels[merkleDepth] the leaves
+func (t *MerkleTree) levels() [][]uint64 {
+	levels := make([][]uint64, merkleDepth+1)
+	t.mu.Lock()
+	levels[merkleDepth] = append([]uint64(nil), t.leaves[:]...)
+	t.mu.Unlock()
+	for l := merkleDepth - 1; l >= 0; l-- {
+		below := levels[l+1]
+		level := make([]uint64, len(below)/2)
+		var buf [16]byte
+		for i := range level {
+			binary.BigEndian.PutUint64(buf[:8], below[2*i])
+			binary.BigEndian.PutUint64(buf[8:], below[2*i+1])
+			hasher := fnv.New64a()
+			hasher.Write(buf[:])
+			level[i] = hasher.Sum64()
+		}
+		levels[l] = level
+	}
+	return levels
+}
+
+// the hashes of the given nodes on one level
+func (t *MerkleTree) hashes(level int, nodes []int) []uint64 {
+	if level < 0 || level > merkleDepth {
+		return nil
+	}
+	all := t.levels()[level]
+	out := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		if n >= 0 && n < len(all) {
+			out[i] = all[n]
+		}
+	}
+	return out
+}
+
+// the keys that fall into the given leaves
+func (t *MerkleTree) keys_in(leaves []int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []string{}
+	for _, leaf := range leaves {
+		if leaf < 0 || leaf >= merkleLeaves {
+			continue
+		}
+		for key := range t.keys[leaf] {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// asks for the hashes of some nodes on one level of the tree
+type merkleRequest struct {
+	Level int   `json:"level"`
+	Nodes []int `json:"nodes"`
+}
+
+type merkleResponse struct {
+	Hashes []uint64 `json:"hashes"`
+	//only for the root, this node's causal knowledge
+	Known vclock.VClock `json:"known,omitempty"`
+}
+
+// sends our keys in the leaves that differ and asks for theirs
+type leavesRequest struct {
+	Leaves []int `json:"leaves"`
+	Keys   []KVS `json:"keys"`
+}
+
+// answers with this node's hashes for the requested tree nodes
+func merkle_hashes(w http.ResponseWriter, r *http.Request) {
+	var req merkleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	res := merkleResponse{}
+	if req.Level == 0 {
+		//before hashing, everything it covers is in the tree already
+		res.Known = causal.snapshot()
+	}
+	res.Hashes = store.Merkle().hashes(req.Level, req.Nodes)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
+// merges the keys the other replica sent for the differing leaves and
+// sends back what this node has in them
+func merkle_leaves(w http.ResponseWriter, r *http.Request) {
+	var req leavesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	//read ours before merging so we don't send their own keys back
+	ours := records_in(req.Leaves)
+	merge_keys(req.Keys)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(ours)
+}
+
+// every version this node has in the given leaves
+func records_in(leaves []int) []KVS {
+	records := []KVS{}
+	for _, key := range store.Merkle().keys_in(leaves) {
+		if item, ok := store.Get(key); ok {
+			records = append(records, item)
+		}
+	}
+	return records
+}
+
+// walks down the tree with one replica and swaps the keys that differ
+func anti_entropy(address string) {
+	client := http.Client{
+		Timeout: time.Second * 1,
+	}
+	tree := store.Merkle()
+
+	nodes := []int{0}
+	var known vclock.VClock
+	for level := 0; level <= merkleDepth && len(nodes) > 0; level++ {
+		theirs := merkleResponse{}
+		if !put_json(&client, "http://"+address+"/gossip/merkle", merkleRequest{level, nodes}, &theirs) {
+			return
+		}
+		if len(theirs.Hashes) != len(nodes) {
+			return
+		}
+		if level == 0 {
+			known = theirs.Known
+		}
+		ours := tree.hashes(level, nodes)
+		differ := []int{}
+		for i, n := range nodes {
+			if ours[i] != theirs.Hashes[i] {
+				differ = append(differ, n)
+			}
+		}
+		if level == merkleDepth {
+			nodes = differ
+			break
+		}
+		nodes = nodes[:0:0]
+		for _, n := range differ {
+			nodes = append(nodes, 2*n, 2*n+1)
+		}
+	}
+	if len(nodes) == 0 {
+		//in sync
+		causal.learn(known)
+		return
+	}
+
+	//nodes are the leaves that differ now
+	var theirs []KVS
+	if !put_json(&client, "http://"+address+"/gossip/leaves", leavesRequest{nodes, records_in(nodes)}, &theirs) {
+		return
+	}
+	merge_keys(theirs)
+	causal.learn(known)
+}
+
+// PUTs a JSON body and decodes the JSON answer into out
+func put_json(client *http.Client, url string, body interface{}, out interface{}) bool {
+	view_marshalled, _ := json.Marshal(body)
+	r, err := http.NewRequest("PUT", url, bytes.NewReader(view_marshalled))
+	if err != nil {
+		return false
+	}
+	r.Header.Add("Content-Type", "application/json")
+	with_clock(r)
+	response, err := client.Do(r)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return false
+	}
+	return json.NewDecoder(response.Body).Decode(out) == nil
+}
+
+// runs anti-entropy with the other replicas of this shard
+func gossip_kvs() {
+	view := load_view()
+	if !view.inView {
+		return
+	}
+	for _, address := range live_first(shard_peers(view)) {
+		anti_entropy(address)
+	}
+}
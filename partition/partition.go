@@ -0,0 +1,246 @@
+// Package partition decides which shard a key lives on and which
+// nodes make up each shard. The server and the client both use it,
+// so they always agree on where a key goes.
+package partition
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Partitioner maps keys onto a fixed number of shards.
+// Shards are numbered 0 to Shards()-1.
+type Partitioner interface {
+	Shard(key string) int
+	Shards() int
+}
+
+// the kinds of partitioner New knows about
+const (
+	KindRing = "ring"
+	KindJump = "jump"
+)
+
+// how many points each shard gets on the ring by default
+const DefaultVNodes = 128
+
+// Config is what a partitioner is built from. Nodes hand it out with the
+// view, so a client can place keys the way they do.
+type Config struct {
+	Kind   string `json:"kind"`
+	VNodes int    `json:"vnodes"`
+}
+
+// New builds a partitioner of the given kind over shards shards.
+// vnodes is only used by the ring.
+func New(kind string, shards int, vnodes int) (Partitioner, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("partition: need at least one shard, got %d", shards)
+	}
+	switch kind {
+	case "", KindRing:
+		if vnodes <= 0 {
+			vnodes = DefaultVNodes
+		}
+		return NewRing(shards, vnodes), nil
+	case KindJump:
+		return NewJump(shards), nil
+	}
+	return nil, fmt.Errorf("partition: unknown partitioner %q", kind)
+}
+
+// Hash is the 64 bit hash every partitioner places keys with.
+// FNV-1a on its own doesn't spread similar strings well over the high
+// bits, so the result goes through the splitmix64 finalizer.
+func Hash(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return mix(hasher.Sum64())
+}
+
+func mix(z uint64) uint64 {
+	z ^= z >> 30
+	z *= 0xbf58476d1ce4e5b9
+	z ^= z >> 27
+	z *= 0x94d049bb133111eb
+	z ^= z >> 31
+	return z
+}
+
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// Ring is a consistent hash ring where every shard owns vnodes points.
+// A key belongs to the shard of the first point at or after its hash.
+// Adding a shard only takes keys from the points it lands in front of,
+// about 1/N of them, and spreads them evenly over the old shards.
+type Ring struct {
+	points []point
+	shards int
+}
+
+func NewRing(shards int, vnodes int) *Ring {
+	r := &Ring{shards: shards, points: make([]point, 0, shards*vnodes)}
+	for s := 0; s < shards; s++ {
+		for v := 0; v < vnodes; v++ {
+			r.points = append(r.points, point{Hash("shard-" + strconv.Itoa(s) + "-vnode-" + strconv.Itoa(v)), s})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].shard < r.points[j].shard
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (r *Ring) Shard(key string) int {
+	h := Hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		//wrap around
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+func (r *Ring) Shards() int {
+	return r.shards
+}
+
+// Jump is Lamping and Veach's jump consistent hash over the shard count.
+// It needs no memory and moves exactly the keys the new shard takes.
+type Jump struct {
+	shards int
+}
+
+func NewJump(shards int) Jump {
+	return Jump{shards}
+}
+
+func (j Jump) Shard(key string) int {
+	return JumpHash(Hash(key), j.shards)
+}
+
+func (j Jump) Shards() int {
+	return j.shards
+}
+
+// JumpHash maps key onto one of buckets buckets.
+func JumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// the ways Assign can spread nodes over shards
+const (
+	//node i goes to shard i % shards, like the original set_shardView
+	PlacementRoundRobin = "roundrobin"
+	//the first len/shards nodes go to shard 0, the next ones to shard 1...
+	PlacementContiguous = "contiguous"
+)
+
+// Assign splits nodes into shards replica groups. The order of nodes
+// matters, every node has to be given the same list. prev is the groups
+// of the view before, nil for the first one. A node that is still around
+// stays in its group unless the group has more than its share, so
+// adding a shard only takes the nodes the new shard needs and the data
+// that moves is about what the keys moving to it hold.
+func Assign(prev [][]string, nodes []string, shards int, placement string) ([][]string, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("partition: need at least one shard, got %d", shards)
+	}
+	if placement != "" && placement != PlacementRoundRobin && placement != PlacementContiguous {
+		return nil, fmt.Errorf("partition: unknown placement %q", placement)
+	}
+	groups := make([][]string, shards)
+	for i := range groups {
+		groups[i] = []string{}
+	}
+	if len(prev) > 0 {
+		return keep(prev, groups, nodes), nil
+	}
+	switch placement {
+	case "", PlacementRoundRobin:
+		for i, node := range nodes {
+			groups[i%shards] = append(groups[i%shards], node)
+		}
+	case PlacementContiguous:
+		//the first len%shards shards get one extra node
+		per := len(nodes) / shards
+		extra := len(nodes) % shards
+		i := 0
+		for s := 0; s < shards; s++ {
+			n := per
+			if s < extra {
+				n++
+			}
+			groups[s] = append(groups[s], nodes[i:i+n]...)
+			i += n
+		}
+	}
+	return groups, nil
+}
+
+// fills groups from the previous ones, moving as few nodes as it can
+func keep(prev [][]string, groups [][]string, nodes []string) [][]string {
+	shards := len(groups)
+	left := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		left[node] = true
+	}
+	for s := 0; s < shards && s < len(prev); s++ {
+		for _, node := range prev[s] {
+			if left[node] {
+				groups[s] = append(groups[s], node)
+				delete(left, node)
+			}
+		}
+	}
+	//the extra nodes go to the groups that already have the most, so
+	//they don't have to give any up
+	order := make([]int, shards)
+	for s := range order {
+		order[s] = s
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(groups[order[i]]) > len(groups[order[j]])
+	})
+	size := make([]int, shards)
+	for i, s := range order {
+		size[s] = len(nodes) / shards
+		if i < len(nodes)%shards {
+			size[s]++
+		}
+	}
+	for s := range groups {
+		if len(groups[s]) > size[s] {
+			for _, node := range groups[s][size[s]:] {
+				left[node] = true
+			}
+			groups[s] = groups[s][:size[s]]
+		}
+	}
+	//new nodes and the ones given up, in the order of nodes
+	s := 0
+	for _, node := range nodes {
+		if !left[node] {
+			continue
+		}
+		for len(groups[s]) >= size[s] {
+			s++
+		}
+		groups[s] = append(groups[s], node)
+	}
+	return groups
+}
@@ -0,0 +1,345 @@
+package partition
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const testKeys = 100000
+
+func testKey(i int) string {
+	return "key" + strconv.Itoa(i)
+}
+
+// how far from an even share each partitioner's shards may be. The ring's
+// shares depend on where its 128 points per shard happen to land, jump's
+// only on the keys
+var balanceSlack = map[string]float64{
+	KindRing: 0.25,
+	KindJump: 0.05,
+}
+
+func TestBalance(t *testing.T) {
+	for kind, slack := range balanceSlack {
+		for shards := 1; shards <= 10; shards++ {
+			p, err := New(kind, shards, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := make([]int, shards)
+			for i := 0; i < testKeys; i++ {
+				counts[p.Shard(testKey(i))]++
+			}
+			even := float64(testKeys) / float64(shards)
+			for shard, n := range counts {
+				if share := float64(n) / even; share < 1-slack || share > 1+slack {
+					t.Errorf("%s with %d shards: shard %d has %.2f of an even share", kind, shards, shard, share)
+				}
+			}
+		}
+	}
+}
+
+// how far from 1/(N+1) the keys moved going from N to N+1 shards may be,
+// as a fraction of it. The ring moves what the new shard's points take,
+// which comes out uneven with the shards' uneven sizes
+var movedSlack = map[string]float64{
+	KindRing: 0.3,
+	KindJump: 0.05,
+}
+
+func TestAddShardMovesOneShare(t *testing.T) {
+	for kind, slack := range movedSlack {
+		for shards := 1; shards <= 10; shards++ {
+			before, err := New(kind, shards, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := New(kind, shards+1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			moved := 0
+			for i := 0; i < testKeys; i++ {
+				from, to := before.Shard(testKey(i)), after.Shard(testKey(i))
+				if from == to {
+					continue
+				}
+				//keys only ever move to the new shard, never between old ones
+				if to != shards {
+					t.Fatalf("%s from %d shards: %s moved from %d to %d", kind, shards, testKey(i), from, to)
+				}
+				moved++
+			}
+			ideal := 1 / float64(shards+1)
+			fraction := float64(moved) / testKeys
+			if fraction < ideal*(1-slack) || fraction > ideal*(1+slack) {
+				t.Errorf("%s from %d shards: moved %.3f of the keys, want about %.3f", kind, shards, fraction, ideal)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if p, err := New("", 3, 0); err != nil || p.Shards() != 3 {
+		t.Errorf("default partitioner: %v, %v", p, err)
+	}
+	if _, ok := mustNew(t, KindRing, 3).(*Ring); !ok {
+		t.Error("ring kind didn't give a ring")
+	}
+	if _, ok := mustNew(t, KindJump, 3).(Jump); !ok {
+		t.Error("jump kind didn't give jump hashing")
+	}
+	if _, err := New(KindRing, 0, 0); err == nil {
+		t.Error("no error for zero shards")
+	}
+	if _, err := New("modulo", 3, 0); err == nil {
+		t.Error("no error for an unknown kind")
+	}
+}
+
+func mustNew(t *testing.T, kind string, shards int) Partitioner {
+	t.Helper()
+	p, err := New(kind, shards, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAssign(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		placement string
+		want      [][]string
+	}{
+		{PlacementRoundRobin, [][]string{{"a", "c", "e"}, {"b", "d"}}},
+		{PlacementContiguous, [][]string{{"a", "b", "c"}, {"d", "e"}}},
+	}
+	for _, test := range tests {
+		got, err := Assign(nil, nodes, 2, test.placement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.placement, got, test.want)
+		}
+	}
+	if _, err := Assign(nil, nodes, 2, "random"); err == nil {
+		t.Error("no error for an unknown placement")
+	}
+}
+
+func TestAssignKeepsNodes(t *testing.T) {
+	prev := [][]string{{"a", "c", "e"}, {"b", "d"}}
+	tests := []struct {
+		name   string
+		nodes  []string
+		shards int
+		want   [][]string
+	}{
+		{"same view", []string{"a", "b", "c", "d", "e"}, 2, prev},
+		{"new shard", []string{"a", "b", "c", "d", "e"}, 3, [][]string{{"a", "c"}, {"b", "d"}, {"e"}}},
+		{"new node", []string{"a", "b", "c", "d", "e", "f"}, 2, [][]string{{"a", "c", "e"}, {"b", "d", "f"}}},
+		{"node gone", []string{"b", "c", "d", "e"}, 2, [][]string{{"c", "e"}, {"b", "d"}}},
+		{"shard gone", []string{"a", "b", "c", "d", "e"}, 1, [][]string{{"a", "c", "e", "b", "d"}}},
+	}
+	for _, test := range tests {
+		got, err := Assign(prev, test.nodes, test.shards, PlacementRoundRobin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// adding a shard copies about 1/(N+1) of the data onto nodes that didn't
+// have it, counted over every replica of every key and not just by the
+// shard a key goes to
+func TestAddShardMovesOneShareOfData(t *testing.T) {
+	nodes := []string{}
+	for i := 0; i < 12; i++ {
+		nodes = append(nodes, "node"+strconv.Itoa(i))
+	}
+	for kind, slack := range movedSlack {
+		for shards := 1; shards <= 5; shards++ {
+			groups, err := Assign(nil, nodes, shards, PlacementRoundRobin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, err := Assign(groups, nodes, shards+1, PlacementRoundRobin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, after := mustNew(t, kind, shards), mustNew(t, kind, shards+1)
+			copied, total := 0, 0
+			for i := 0; i < testKeys; i++ {
+				had := groups[before.Shard(testKey(i))]
+				for _, node := range next[after.Shard(testKey(i))] {
+					total++
+					if !contains(had, node) {
+						copied++
+					}
+				}
+			}
+			ideal := 1 / float64(shards+1)
+			if fraction := float64(copied) / float64(total); fraction > ideal*(1+slack) {
+				t.Errorf("%s from %d shards: copied %.3f of the data, want at most about %.3f", kind, shards, fraction, ideal)
+			}
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRangeMapFind(t *testing.T) {
+	m := RangeMap{{"user/", 0}, {"user/g", 1}, {"user/p", 2}}
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"user/", 0},
+		{"user/a", 0},
+		{"user/fzz", 0},
+		//a range starts at its Start, inclusive
+		{"user/g", 1},
+		{"user/g0", 1},
+		{"user/oz", 1},
+		{"user/p", 2},
+		{"user/zzz", 2},
+		//keys before the first range still land in it
+		{"a", 0},
+	}
+	for _, test := range tests {
+		if got := m.Find(test.key); got != test.want {
+			t.Errorf("Find(%q) = %d, want %d", test.key, got, test.want)
+		}
+	}
+	for i, want := range []struct {
+		end string
+		ok  bool
+	}{{"user/g", true}, {"user/p", true}, {"", false}} {
+		if end, ok := m.End(i); end != want.end || ok != want.ok {
+			t.Errorf("End(%d) = %q, %v, want %q, %v", i, end, ok, want.end, want.ok)
+		}
+	}
+}
+
+func TestRangeMapSplit(t *testing.T) {
+	m := RangeMap{{"user/", 0}, {"user/p", 1}}
+	tests := []struct {
+		at    string
+		shard int
+		want  RangeMap
+	}{
+		{"user/g", 2, RangeMap{{"user/", 0}, {"user/g", 2}, {"user/p", 1}}},
+		{"user/x", 0, RangeMap{{"user/", 0}, {"user/p", 1}, {"user/x", 0}}},
+		{"user/\x00", 1, RangeMap{{"user/", 0}, {"user/\x00", 1}, {"user/p", 1}}},
+		//on a boundary already, or before the keyspace
+		{"user/", 1, nil},
+		{"user/p", 2, nil},
+		{"a", 1, nil},
+	}
+	for _, test := range tests {
+		got, err := m.Split(test.at, test.shard)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("Split(%q) = %v, want an error", test.at, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Split(%q): %v", test.at, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Split(%q) = %v, want %v", test.at, got, test.want)
+		}
+	}
+	//the map it was split from doesn't change
+	if !reflect.DeepEqual(m, RangeMap{{"user/", 0}, {"user/p", 1}}) {
+		t.Errorf("Split changed the map to %v", m)
+	}
+	if _, err := (RangeMap{}).Split("a", 0); err == nil {
+		t.Error("no error splitting an empty map")
+	}
+}
+
+func TestKeyspaceShard(t *testing.T) {
+	k, err := NewKeyspace("user/", ModeRange, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Ranges, err = k.Ranges.Split("user/m", 3); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		shards int
+		want   int
+	}{
+		{"user/a", 4, 1},
+		{"user/m", 4, 3},
+		{"user/z", 4, 3},
+		//a range on a shard that's gone wraps around
+		{"user/z", 2, 1},
+		{"user/z", 0, 0},
+	}
+	for _, test := range tests {
+		if got := k.Shard(test.key, test.shards); got != test.want {
+			t.Errorf("Shard(%q, %d) = %d, want %d", test.key, test.shards, got, test.want)
+		}
+	}
+	if _, err := NewKeyspace("", ModeRange, 0); err == nil {
+		t.Error("no error for a keyspace without a prefix")
+	}
+	if _, err := NewKeyspace("user/", "hash", 0); err == nil {
+		t.Error("no error for an unknown mode")
+	}
+}
+
+func TestFindKeyspace(t *testing.T) {
+	keyspaces := []Keyspace{
+		{Prefix: "user/", Mode: ModeRange, Ranges: RangeMap{{"user/", 0}}},
+		{Prefix: "user/admin/", Mode: ModeRange, Ranges: RangeMap{{"user/admin/", 1}}},
+		//without ranges it doesn't place anything
+		{Prefix: "log/", Mode: ModeRange},
+		{Prefix: "tmp/", Mode: "hash", Ranges: RangeMap{{"tmp/", 0}}},
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"user/bob", "user/"},
+		{"user/", "user/"},
+		//the longest prefix wins
+		{"user/admin/root", "user/admin/"},
+		{"user/admin", "user/"},
+		{"log/1", ""},
+		{"tmp/1", ""},
+		{"users", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if k := FindKeyspace(keyspaces, test.key); k != nil {
+			got = k.Prefix
+		}
+		if got != test.want {
+			t.Errorf("FindKeyspace(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+	if FindKeyspace(nil, "user/bob") != nil {
+		t.Error("found a keyspace in an empty list")
+	}
+}
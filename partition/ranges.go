@@ -0,0 +1,103 @@
+package partition
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the mode a keyspace can be created in, shards own contiguous ranges of
+// its keys so they can be scanned in order. Keys outside of a keyspace
+// are spread by the partitioner
+const ModeRange = "range"
+
+// Range is one contiguous piece of a range-partitioned keyspace. It holds
+// every key from Start up to (not including) the Start of the next one.
+type Range struct {
+	Start string `json:"start"`
+	Shard int    `json:"shard_id"`
+}
+
+// RangeMap is the ranges of a keyspace sorted by Start. The first one
+// starts at the keyspace's prefix, so every key in it falls in a range.
+type RangeMap []Range
+
+// Find gives back the index of the range key falls in.
+func (m RangeMap) Find(key string) int {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Start > key })
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// End gives back where range i stops, false for the last one.
+func (m RangeMap) End(i int) (string, bool) {
+	if i+1 >= len(m) {
+		return "", false
+	}
+	return m[i+1].Start, true
+}
+
+// Split cuts the range holding at in two. The new range starts at at
+// and goes to shard, the old one keeps everything before it.
+func (m RangeMap) Split(at string, shard int) (RangeMap, error) {
+	i := m.Find(at)
+	if len(m) == 0 || m[i].Start == at || at < m[0].Start {
+		return nil, fmt.Errorf("partition: can't split at %q", at)
+	}
+	out := make(RangeMap, 0, len(m)+1)
+	out = append(out, m[:i+1]...)
+	out = append(out, Range{at, shard})
+	return append(out, m[i+1:]...), nil
+}
+
+// Keyspace is every key starting with Prefix, placed by its own rules
+// instead of the partitioner.
+type Keyspace struct {
+	Prefix string   `json:"prefix"`
+	Mode   string   `json:"mode"`
+	Ranges RangeMap `json:"ranges,omitempty"`
+}
+
+// NewKeyspace makes a keyspace of the given mode. It starts out as a
+// single range on shard.
+func NewKeyspace(prefix string, mode string, shard int) (Keyspace, error) {
+	if prefix == "" {
+		return Keyspace{}, fmt.Errorf("partition: a keyspace needs a prefix")
+	}
+	if mode != ModeRange {
+		return Keyspace{}, fmt.Errorf("partition: unknown keyspace mode %q", mode)
+	}
+	return Keyspace{Prefix: prefix, Mode: ModeRange, Ranges: RangeMap{{prefix, shard}}}, nil
+}
+
+// Ranged tells if the keyspace places its keys by range.
+func (k Keyspace) Ranged() bool {
+	return k.Mode == ModeRange && len(k.Ranges) > 0
+}
+
+// Shard gives back the shard a key of the keyspace lives on, out of shards.
+// Ranges that were given to a shard that's gone since wrap around.
+func (k Keyspace) Shard(key string, shards int) int {
+	if shards <= 0 {
+		return 0
+	}
+	return k.Ranges[k.Ranges.Find(key)].Shard % shards
+}
+
+// FindKeyspace gives back the range keyspace with the longest prefix
+// that key starts with, or nil when the key isn't in one.
+func FindKeyspace(keyspaces []Keyspace, key string) *Keyspace {
+	var best *Keyspace
+	for i := range keyspaces {
+		k := &keyspaces[i]
+		if !k.Ranged() || !strings.HasPrefix(key, k.Prefix) {
+			continue
+		}
+		if best == nil || len(k.Prefix) > len(best.Prefix) {
+			best = k
+		}
+	}
+	return best
+}
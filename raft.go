@@ -0,0 +1,1046 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Raft for the keys that have to be linearizable. When LINEARIZABLE is
+// set to a comma separated list of key prefixes, the replicas of every
+// shard run a raft group and the keys under those prefixes go through
+// its leader: a write is answered once a majority has it in their log
+// and it was applied, a read once the leader made sure it still is one.
+// Followers redirect clients to the leader. Every view change starts a
+// new group, with its own terms and log, over the new replica group.
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+)
+
+// what gets applied to the store once an entry is committed
+type raftCommand struct {
+	//"put", "delete", "expire", "merge" or "noop"
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"val,omitempty"`
+	//for "put", the client's causal metadata for the shard
+	Vector vclock.VClock `json:"causal-metadata,omitempty"`
+	//set by the leader so every replica applies the same thing
+	Time time.Time `json:"time"`
+	//for "put", "delete" and "expire", the leader's dot for the write
+	Dot Dot `json:"dot"`
+	//for "merge", a version of the key that came from somewhere else
+	KVS *KVS `json:"kvs,omitempty"`
+	//for "put" and "delete", checked when the entry is applied
+	If *Condition `json:"if,omitempty"`
+	//for "put", seconds from Time until the key expires
+	TTL int `json:"ttl,omitempty"`
+	//the leader's stamp for the write, every replica stores the same one
+	HLC HLC `json:"hlc"`
+}
+
+type raftEntry struct {
+	Term    uint64      `json:"term"`
+	Command raftCommand `json:"command"`
+}
+
+type voteRequest struct {
+	Epoch     uint64 `json:"epoch"`
+	RequestID string `json:"request_id"`
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Epoch     uint64      `json:"epoch"`
+	RequestID string      `json:"request_id"`
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries"`
+	Commit    uint64      `json:"commit"`
+}
+
+type appendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	//where the leader should try again from when it didn't work
+	Next uint64 `json:"next"`
+}
+
+// what a leader sends a follower that needs entries it compacted away
+type snapshotRequest struct {
+	Epoch     uint64 `json:"epoch"`
+	RequestID string `json:"request_id"`
+	Term      uint64 `json:"term"`
+	Leader    string `json:"leader"`
+	//the last entry the keys include
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+	//every linearizable key the leader has
+	Keys []KVS `json:"keys"`
+}
+
+// what applying an entry did to its key
+type applyResult struct {
+	item    KVS
+	changed bool
+	//the command's condition didn't hold
+	failed bool
+	found  bool
+	//the term of the entry, it isn't the one that was proposed
+	//if another leader's went in at the same index
+	term uint64
+}
+
+var errNotLeader = errors.New("not the leader")
+var errNoLeader = errors.New("no leader")
+var errRaftTimeout = errors.New("timed out waiting for the raft group")
+
+// one node's part in the raft group of its shard
+type raftNode struct {
+	mu sync.Mutex
+	//the view the group belongs to
+	epoch     uint64
+	requestID string
+	self      string
+	peers     []string
+
+	term     uint64
+	votedFor string
+	//log[0] stands for the last entry compacted away, at index base,
+	//so the first entry in the log has index base+1
+	log     []raftEntry
+	base    uint64
+	commit  uint64
+	applied uint64
+	role    string
+	leader  string
+
+	//leader only
+	next     map[string]uint64
+	match    map[string]uint64
+	lastBeat time.Time
+
+	lastHeard time.Time
+	timeout   time.Duration
+	//results of the entries somebody is waiting on, by index
+	results map[uint64]*applyResult
+	//gets closed every time entries are applied
+	appliedCh chan struct{}
+	rng       *rand.Rand
+	//where the log is saved, empty with STORAGE=memory
+	path string
+	disk *os.File
+	//the term and vote the file has last
+	savedTerm uint64
+	savedVote string
+}
+
+// knobs, set by LINEARIZABLE (key prefixes), RAFT_HEARTBEAT and
+// RAFT_ELECTION_TIMEOUT (milliseconds). A follower that doesn't hear
+// from a leader for between one and two election timeouts runs for it
+var linearizablePrefixes []string
+var raftHeartbeat = 150 * time.Millisecond
+var raftElection = time.Second
+
+// how many entries go out in one append
+const raftBatch = 100
+
+var raftMu sync.Mutex
+var raftGroup *raftNode
+
+func load_raft() {
+	for _, prefix := range strings.Split(os.Getenv("LINEARIZABLE"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			linearizablePrefixes = append(linearizablePrefixes, prefix)
+		}
+	}
+	raftHeartbeat = env_duration("RAFT_HEARTBEAT", time.Millisecond, raftHeartbeat)
+	raftElection = env_duration("RAFT_ELECTION_TIMEOUT", time.Millisecond, raftElection)
+	raftSnapshotEntries = env_int("RAFT_SNAPSHOT_ENTRIES", raftSnapshotEntries)
+}
+
+// whether the key lives in a linearizable keyspace
+func linearizable(key string) bool {
+	for _, prefix := range linearizablePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// the raft group this node is in right now, nil if there is none
+func raft_node() *raftNode {
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	return raftGroup
+}
+
+// starts a new group when the view changed, drops it when we left
+func sync_raft_group() *raftNode {
+	v := load_view()
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	if !v.inView || v.selfID < 0 || v.selfID >= len(v.shards) {
+		if raftGroup != nil {
+			raftGroup.close()
+		}
+		raftGroup = nil
+		return nil
+	}
+	if raftGroup != nil && raftGroup.epoch == v.current.Epoch && raftGroup.requestID == v.current.RequestID {
+		return raftGroup
+	}
+	if raftGroup != nil {
+		raftGroup.close()
+	}
+	raftGroup = new_raft(v)
+	return raftGroup
+}
+
+func new_raft(v viewState) *raftNode {
+	n := &raftNode{
+		epoch:     v.current.Epoch,
+		requestID: v.current.RequestID,
+		self:      os.Getenv("ADDRESS"),
+		peers:     shard_peers(v),
+		log:       []raftEntry{{}},
+		role:      RaftFollower,
+		lastHeard: time.Now(),
+		results:   make(map[uint64]*applyResult),
+		appliedCh: make(chan struct{}),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	n.timeout = n.random_timeout()
+	if os.Getenv("STORAGE") != "memory" {
+		n.path = raft_log_path()
+		n.restore()
+	}
+	return n
+}
+
+func (n *raftNode) random_timeout() time.Duration {
+	return raftElection + time.Duration(n.rng.Int63n(int64(raftElection)))
+}
+
+func (n *raftNode) last_index() uint64 {
+	return n.base + uint64(len(n.log)-1)
+}
+
+func (n *raftNode) majority(votes int) bool {
+	return votes*2 > len(n.peers)+1
+}
+
+func (n *raftNode) same_group(epoch uint64, requestID string) bool {
+	return n.epoch == epoch && n.requestID == requestID
+}
+
+// goes back to being a follower, must be called with mu held
+func (n *raftNode) step_down(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.role = RaftFollower
+	n.persist()
+}
+
+// one step of the timers
+func (n *raftNode) tick() {
+	n.mu.Lock()
+	if n.role == RaftLeader {
+		due := time.Since(n.lastBeat) >= raftHeartbeat
+		n.mu.Unlock()
+		if due {
+			go n.broadcast()
+		}
+		return
+	}
+	waited := time.Since(n.lastHeard) >= n.timeout
+	n.mu.Unlock()
+	if waited {
+		n.elect()
+	}
+}
+
+// runs for leader
+func (n *raftNode) elect() {
+	n.mu.Lock()
+	n.term++
+	n.role = RaftCandidate
+	n.votedFor = n.self
+	n.leader = ""
+	n.lastHeard = time.Now()
+	n.timeout = n.random_timeout()
+	n.persist()
+	term := n.term
+	req := voteRequest{n.epoch, n.requestID, n.term, n.self, n.last_index(), n.term_at(n.last_index())}
+	peers := n.peers
+	if n.majority(1) {
+		n.become_leader()
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	client := http.Client{
+		Timeout: raftElection / 2,
+	}
+	replies := make(chan voteReply, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			var reply voteReply
+			if !put_json(&client, "http://"+address+"/raft/vote", req, &reply) {
+				reply = voteReply{}
+			}
+			replies <- reply
+		}(address)
+	}
+	votes := 1
+	for range peers {
+		reply := <-replies
+		n.mu.Lock()
+		if reply.Term > n.term {
+			n.step_down(reply.Term)
+		}
+		if n.role != RaftCandidate || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if reply.Granted {
+			votes++
+			if n.majority(votes) {
+				n.become_leader()
+				n.mu.Unlock()
+				go n.broadcast()
+				return
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// must be called with mu held
+func (n *raftNode) become_leader() {
+	n.role = RaftLeader
+	n.leader = n.self
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	for _, peer := range n.peers {
+		n.next[peer] = n.last_index() + 1
+		n.match[peer] = 0
+	}
+	//a new leader only knows what's committed once something
+	//from its own term is, so it starts with an empty entry
+	n.log = append(n.log, raftEntry{n.term, raftCommand{Op: "noop", Time: time.Now()}})
+	n.persist_entries(n.last_index())
+	n.advance_commit()
+	fmt.Printf("raft: leader of shard group for epoch %d in term %d\n", n.epoch, n.term)
+}
+
+// sends appends (or just heartbeats) to every follower, gives back
+// how many of the group still take this node as the leader, itself included
+func (n *raftNode) broadcast() int {
+	n.mu.Lock()
+	n.lastBeat = time.Now()
+	peers := n.peers
+	n.mu.Unlock()
+	acks := make(chan bool, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			acks <- n.replicate_to(address)
+		}(address)
+	}
+	count := 1
+	for range peers {
+		if <-acks {
+			count++
+		}
+	}
+	return count
+}
+
+// brings one follower up to date, gives back whether it took us as leader
+func (n *raftNode) replicate_to(peer string) bool {
+	client := http.Client{
+		Timeout: raftElection / 2,
+	}
+	for {
+		n.mu.Lock()
+		if n.role != RaftLeader {
+			n.mu.Unlock()
+			return false
+		}
+		next := n.next[peer]
+		if next < 1 {
+			next = 1
+		}
+		if next <= n.base {
+			//what it's missing was compacted away, it gets the keys instead
+			if !n.send_snapshot(&client, peer) {
+				return false
+			}
+			continue
+		}
+		prev := next - 1
+		end := n.last_index() + 1
+		if end > next+raftBatch {
+			end = next + raftBatch
+		}
+		//copied since the log can be cut once we're not the leader
+		entries := n.entries(next, end)
+		req := appendRequest{n.epoch, n.requestID, n.term, n.self, prev, n.term_at(prev), entries, n.commit}
+		term := n.term
+		n.mu.Unlock()
+
+		var reply appendReply
+		if !put_json(&client, "http://"+peer+"/raft/append", req, &reply) {
+			return false
+		}
+		n.mu.Lock()
+		if reply.Term > n.term {
+			n.step_down(reply.Term)
+		}
+		if n.role != RaftLeader || n.term != term {
+			n.mu.Unlock()
+			return false
+		}
+		if !reply.Success {
+			//their log is missing or has other entries there, back up
+			n.next[peer] = reply.Next
+			if n.next[peer] < 1 {
+				n.next[peer] = 1
+			}
+			n.mu.Unlock()
+			continue
+		}
+		if match := prev + uint64(len(entries)); match > n.match[peer] {
+			n.match[peer] = match
+		}
+		n.next[peer] = n.match[peer] + 1
+		n.advance_commit()
+		done := n.next[peer] > n.last_index()
+		n.mu.Unlock()
+		if done {
+			return true
+		}
+	}
+}
+
+// sends the linearizable keys as of the last applied entry to a follower
+// that is behind the compacted part of the log. Must be called with mu
+// held, gives it back unlocked. Returns whether it took them
+func (n *raftNode) send_snapshot(client *http.Client, peer string) bool {
+	req := snapshotRequest{n.epoch, n.requestID, n.term, n.self, n.applied, n.term_at(n.applied), linearizable_keys()}
+	term := n.term
+	n.mu.Unlock()
+
+	var reply appendReply
+	if !put_json(client, "http://"+peer+"/raft/snapshot", req, &reply) {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.step_down(reply.Term)
+	}
+	if n.role != RaftLeader || n.term != term || !reply.Success {
+		return false
+	}
+	if req.LastIndex > n.match[peer] {
+		n.match[peer] = req.LastIndex
+	}
+	n.next[peer] = n.match[peer] + 1
+	n.advance_commit()
+	return true
+}
+
+// every linearizable key in the store
+func linearizable_keys() []KVS {
+	keys := []KVS{}
+	store.Range(func(k KVS) bool {
+		if linearizable(k.Key) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+// commits whatever a majority has, must be called with mu held.
+// Only entries from the current term are counted (raft 5.4.2)
+func (n *raftNode) advance_commit() {
+	for i := n.last_index(); i > n.commit; i-- {
+		if n.term_at(i) != n.term {
+			break
+		}
+		votes := 1
+		for _, peer := range n.peers {
+			if n.match[peer] >= i {
+				votes++
+			}
+		}
+		if n.majority(votes) {
+			n.commit = i
+			n.apply()
+			break
+		}
+	}
+}
+
+// applies the committed entries to the store, must be called with mu held
+func (n *raftNode) apply() {
+	if n.applied >= n.commit {
+		return
+	}
+	for n.applied < n.commit {
+		n.applied++
+		e := n.entry(n.applied)
+		res := apply_command(e.Command)
+		res.term = e.Term
+		if _, waiting := n.results[n.applied]; waiting {
+			n.results[n.applied] = &res
+		}
+	}
+	n.persist_applied()
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+}
+
+// does what the command says to the store, the same way on every replica
+// puts the leader's stamp on a version the command wrote, entries
+// logged before there were stamps keep the one this node made
+func (cmd raftCommand) stamp(item *KVS) {
+	if !cmd.HLC.zero() {
+		item.HLC = cmd.HLC
+	}
+}
+
+// whether the key's version is the one the command wrote, which is the
+// case for the last entries applied before a crash when the applied index
+// didn't make it to disk
+func (cmd raftCommand) applied(item KVS, found bool) bool {
+	return found && cmd.Dot.Counter != 0 && item.Dot == cmd.Dot
+}
+
+func apply_command(cmd raftCommand) applyResult {
+	var res applyResult
+	var err error
+	switch cmd.Op {
+	case "put":
+		res.item, err = store.Update(cmd.Key, func(item KVS, found bool) (KVS, bool) {
+			if cmd.applied(item, found) {
+				return item, false
+			}
+			if cmd.If != nil && !cmd.If.holds(item, found, cmd.Time) {
+				res.failed, res.found = true, found
+				return item, false
+			}
+			res.changed = true
+			next := put_item(item, found, cmd.Key, cmd.Value, cmd.Vector, cmd.Dot, cmd.Time)
+			next.Expires = expiry(cmd.TTL, cmd.Time)
+			cmd.stamp(&next)
+			return next, true
+		})
+	case "delete":
+		res.item, err = store.Update(cmd.Key, func(item KVS, found bool) (KVS, bool) {
+			if cmd.applied(item, found) {
+				return item, false
+			}
+			if cmd.If != nil && !cmd.If.holds(item, found, cmd.Time) {
+				res.failed, res.found = true, found
+				return item, false
+			}
+			if !present(item, found, cmd.Time) {
+				return item, false
+			}
+			res.changed = true
+			next := delete_item(item, cmd.Dot, cmd.Time)
+			cmd.stamp(&next)
+			return next, true
+		})
+	case "expire":
+		//the leader's clock decides, so every replica agrees on it
+		res.item, err = store.Update(cmd.Key, func(item KVS, found bool) (KVS, bool) {
+			if !found || item.Deleted || !expired(item, cmd.Time) {
+				return item, false
+			}
+			res.changed = true
+			next := expire_item(item, cmd.Dot, cmd.Time)
+			cmd.stamp(&next)
+			return next, true
+		})
+	case "merge":
+		if cmd.KVS != nil {
+			res.item, err = merge_replica(*cmd.KVS)
+			res.changed = true
+		}
+	}
+	if err != nil {
+		fmt.Printf("storage: %v\n", err)
+	}
+	return res
+}
+
+// adds a command to the log if this node is the leader, gives back its index and term
+func (n *raftNode) propose(cmd raftCommand) (uint64, uint64, error) {
+	n.mu.Lock()
+	if n.role != RaftLeader {
+		n.mu.Unlock()
+		return 0, 0, errNotLeader
+	}
+	n.log = append(n.log, raftEntry{n.term, cmd})
+	index, term := n.last_index(), n.term
+	n.results[index] = nil
+	n.persist_entries(index)
+	n.advance_commit()
+	n.mu.Unlock()
+	go n.broadcast()
+	return index, term, nil
+}
+
+// waits until the entry is applied. If another leader overwrote it
+// it never will be, that counts as losing the leadership
+func (n *raftNode) wait_applied(ctx context.Context, index uint64, term uint64) (applyResult, error) {
+	deadline := time.NewTimer(quorumTimeout)
+	defer deadline.Stop()
+	defer func() {
+		n.mu.Lock()
+		delete(n.results, index)
+		n.mu.Unlock()
+	}()
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			res := n.results[index]
+			n.mu.Unlock()
+			//nothing was applied for it here, the keys came in a snapshot
+			if res == nil || res.term != term {
+				return applyResult{}, errNotLeader
+			}
+			return *res, nil
+		}
+		changed := n.appliedCh
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return applyResult{}, errRaftTimeout
+		case <-ctx.Done():
+			return applyResult{}, errRaftTimeout
+		}
+	}
+}
+
+// runs a command through the log and waits for it to be applied
+func (n *raftNode) submit(ctx context.Context, cmd raftCommand) (applyResult, error) {
+	index, term, err := n.propose(cmd)
+	if err != nil {
+		return applyResult{}, err
+	}
+	return n.wait_applied(ctx, index, term)
+}
+
+// makes sure this node can answer a read: it has to be the leader, know
+// what's committed and still have a majority behind it
+func (n *raftNode) read_index(ctx context.Context) error {
+	deadline := time.NewTimer(quorumTimeout)
+	defer deadline.Stop()
+	for {
+		n.mu.Lock()
+		if n.role != RaftLeader {
+			n.mu.Unlock()
+			return errNotLeader
+		}
+		if n.term_at(n.commit) == n.term {
+			break
+		}
+		//still waiting on the entry from our own term
+		changed := n.appliedCh
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return errRaftTimeout
+		}
+	}
+	index := n.commit
+	n.mu.Unlock()
+
+	if !n.majority(n.broadcast()) {
+		return errNotLeader
+	}
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		changed := n.appliedCh
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return errRaftTimeout
+		case <-ctx.Done():
+			return errRaftTimeout
+		}
+	}
+}
+
+func (n *raftNode) current_leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == RaftLeader {
+		return n.self
+	}
+	return n.leader
+}
+
+func (n *raftNode) handle_vote(req voteRequest) voteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return voteReply{n.term, false}
+	}
+	if req.Term > n.term {
+		n.step_down(req.Term)
+	}
+	last := n.last_index()
+	upToDate := req.LastTerm > n.term_at(last) || (req.LastTerm == n.term_at(last) && req.LastIndex >= last)
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.lastHeard = time.Now()
+		n.persist()
+		return voteReply{n.term, true}
+	}
+	return voteReply{n.term, false}
+}
+
+func (n *raftNode) handle_append(req appendRequest) appendReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return appendReply{n.term, false, 0}
+	}
+	if req.Term > n.term || n.role != RaftFollower {
+		n.step_down(req.Term)
+	}
+	n.leader = req.Leader
+	n.lastHeard = time.Now()
+
+	if req.PrevIndex > n.last_index() {
+		return appendReply{n.term, false, n.last_index() + 1}
+	}
+	if req.PrevIndex < n.base {
+		//the start of it is compacted away here, it was applied so it matches
+		skip := n.base - req.PrevIndex
+		if skip >= uint64(len(req.Entries)) {
+			req.Entries = nil
+		} else {
+			req.Entries = req.Entries[skip:]
+		}
+		req.PrevIndex, req.PrevTerm = n.base, n.term_at(n.base)
+	}
+	if n.term_at(req.PrevIndex) != req.PrevTerm {
+		//skip back over the whole conflicting term at once
+		conflict := n.term_at(req.PrevIndex)
+		i := req.PrevIndex
+		for i > n.base+1 && n.term_at(i-1) == conflict {
+			i--
+		}
+		return appendReply{n.term, false, i}
+	}
+	for i, e := range req.Entries {
+		index := req.PrevIndex + 1 + uint64(i)
+		if index <= n.last_index() {
+			if n.term_at(index) == e.Term {
+				continue
+			}
+			//ours disagree with the leader's, they were never committed
+			n.truncate(index)
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		n.persist_entries(index)
+		break
+	}
+	if req.Commit > n.commit {
+		n.commit = req.Commit
+		if last := req.PrevIndex + uint64(len(req.Entries)); n.commit > last {
+			n.commit = last
+		}
+		n.apply()
+	}
+	return appendReply{n.term, true, 0}
+}
+
+// takes the leader's keys in place of the entries up to req.LastIndex
+func (n *raftNode) handle_snapshot(req snapshotRequest) appendReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return appendReply{n.term, false, 0}
+	}
+	if req.Term > n.term || n.role != RaftFollower {
+		n.step_down(req.Term)
+	}
+	n.leader = req.Leader
+	n.lastHeard = time.Now()
+	if req.LastIndex <= n.applied {
+		return appendReply{n.term, true, 0}
+	}
+
+	install_keys(req.Keys)
+	if req.LastIndex <= n.last_index() && n.term_at(req.LastIndex) == req.LastTerm {
+		//the entries after it are still good
+		n.log = append([]raftEntry{{Term: req.LastTerm}}, n.log[req.LastIndex-n.base+1:]...)
+	} else {
+		n.log = []raftEntry{{Term: req.LastTerm}}
+	}
+	n.base = req.LastIndex
+	n.applied = req.LastIndex
+	if n.commit < n.applied {
+		n.commit = n.applied
+	}
+	n.rewrite()
+	n.apply()
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+	return appendReply{n.term, true, 0}
+}
+
+// makes the linearizable keys exactly the leader's
+func install_keys(keys []KVS) {
+	sent := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		k := k
+		sent[k.Key] = true
+		clock.observe(k.HLC)
+		if _, err := store.Update(k.Key, func(KVS, bool) (KVS, bool) { return k, true }); err != nil {
+			fmt.Printf("storage: %v\n", err)
+		}
+	}
+	gone := []string{}
+	store.Range(func(k KVS) bool {
+		if linearizable(k.Key) && !sent[k.Key] {
+			gone = append(gone, k.Key)
+		}
+		return true
+	})
+	for _, key := range gone {
+		if err := store.Remove(key); err != nil {
+			fmt.Printf("storage: %v\n", err)
+		}
+	}
+}
+
+// answers a candidate asking for our vote
+func raft_vote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	n := raft_node()
+	if n == nil || !n.same_group(req.Epoch, req.RequestID) {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not in this raft group"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n.handle_vote(req))
+}
+
+// takes entries (or a heartbeat) from the leader
+func raft_append(w http.ResponseWriter, r *http.Request) {
+	var req appendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	n := raft_node()
+	if n == nil || !n.same_group(req.Epoch, req.RequestID) {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not in this raft group"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n.handle_append(req))
+}
+
+// takes the leader's keys when our log is too far behind
+func raft_snapshot(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	n := raft_node()
+	if n == nil || !n.same_group(req.Epoch, req.RequestID) {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not in this raft group"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(n.handle_snapshot(req))
+}
+
+// runs a command for another node of the shard, only the leader takes it
+func raft_propose(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var cmd raftCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	n := raft_node()
+	if n == nil {
+		raft_error(w, r, nil, errNoLeader)
+		return
+	}
+	res, err := n.submit(r.Context(), cmd)
+	if err != nil {
+		raft_error(w, r, n, err)
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res.item)
+}
+
+// runs a command through the shard's log from any of its nodes,
+// going over to the leader if this node isn't it
+func raft_submit(cmd raftCommand) error {
+	n := raft_node()
+	if n == nil {
+		return errNoLeader
+	}
+	leader := n.current_leader()
+	if leader == "" {
+		return errNoLeader
+	}
+	if leader == n.self {
+		_, err := n.submit(context.Background(), cmd)
+		return err
+	}
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	var item KVS
+	if !put_json(&client, "http://"+leader+"/raft/propose", cmd, &item) {
+		return errNotLeader
+	}
+	return nil
+}
+
+// sends the client to the leader, or tells it there isn't one yet
+func raft_error(w http.ResponseWriter, r *http.Request, n *raftNode, err error) {
+	raft_failure(r.URL.RequestURI(), n, err).write(w)
+}
+
+// what raft_error sends back, uri is where the leader takes the request
+func raft_failure(uri string, n *raftNode, err error) dataResult {
+	leader := ""
+	if n != nil {
+		leader = n.current_leader()
+	}
+	if err == errNotLeader && leader != "" && leader != n.self {
+		res := answer_with(307, map[string]string{"error": "not the leader", "leader": leader})
+		res.location = "http://" + leader + uri
+		return res
+	}
+	if err == errNotLeader {
+		err = errNoLeader
+	}
+	return answer_with(503, map[string]string{"error": err.Error()})
+}
+
+// a write to a linearizable key, this node owns the key's shard
+func raft_write(rctx context.Context, cmd raftCommand, ctx CausalContext) dataResult {
+	uri := "/kvs/data/" + cmd.Key
+	n := raft_node()
+	if n == nil {
+		return raft_failure(uri, nil, errNoLeader)
+	}
+	cmd.Time = time.Now()
+	cmd.HLC = clock.at(cmd.Time)
+	cmd.Dot = dots.next()
+	defer dots.done(cmd.Dot)
+	res, err := n.submit(rctx, cmd)
+	if err != nil {
+		return raft_failure(uri, n, err)
+	}
+	if res.failed {
+		return precondition_failed(res.item, res.found)
+	}
+	if cmd.Op == "delete" && !res.changed {
+		return answer_with(404, map[string]string{"error": "not found"})
+	}
+	return answer_with(200, struct {
+		Clock   vclock.VClock `json:"clock"`
+		Version CausalContext `json:"causal-metadata"`
+	}{res.item.Vector, ctx.with(load_view().selfID, res.item.Vector)})
+}
+
+// a read of a linearizable key, this node owns the key's shard
+func raft_read(rctx context.Context, k string, req DataRequest) dataResult {
+	uri := "/kvs/data/" + k
+	n := raft_node()
+	if n == nil {
+		return raft_failure(uri, nil, errNoLeader)
+	}
+	if err := n.read_index(rctx); err != nil {
+		return raft_failure(uri, n, err)
+	}
+	item, found := store.Get(k)
+	if !present(item, found, time.Now()) {
+		return answer_with(404, struct {
+			Version CausalContext `json:"causal-metadata"`
+		}{req.Vector})
+	}
+	return answer_with(200, struct {
+		Value   string        `json:"val"`
+		Clock   vclock.VClock `json:"clock"`
+		Version CausalContext `json:"causal-metadata"`
+	}{item.Value, item.Vector, req.Vector.with(load_view().selfID, item.Vector)})
+}
+
+// runs the raft timers in the background, only with LINEARIZABLE set
+func start_raft() {
+	if len(linearizablePrefixes) == 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(raftHeartbeat / 3)
+		defer t.Stop()
+		for range t.C {
+			if n := sync_raft_group(); n != nil {
+				n.tick()
+			}
+		}
+	}()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The raft log on disk. Every entry, vote and term change is appended to
+// DATA_DIR/raft.log and fsynced before the node answers for it, instead of
+// the whole state being written out again each time. Entries that were
+// applied are in the store already, so once RAFT_SNAPSHOT_ENTRIES of them
+// pile up the file is rewritten with only the entries after them. The
+// store is the snapshot: a follower that needs entries that were dropped
+// gets the leader's linearizable keys instead (see raft_snapshot).
+
+// one line in raft.log
+type raftRecord struct {
+	//"group", "state", "entry" or "applied"
+	Op string `json:"op"`
+	//for "group", which group the file belongs to and the index and term
+	//of the last entry compacted away
+	Epoch     uint64 `json:"epoch,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Base      uint64 `json:"base,omitempty"`
+	BaseTerm  uint64 `json:"base_term,omitempty"`
+	//for "state"
+	Term     uint64 `json:"term,omitempty"`
+	VotedFor string `json:"voted_for,omitempty"`
+	//for "entry", it replaces whatever was at Index and after it
+	Index uint64     `json:"index,omitempty"`
+	Entry *raftEntry `json:"entry,omitempty"`
+	//for "applied"
+	Applied uint64 `json:"applied,omitempty"`
+}
+
+// how many applied entries are kept before the log is compacted,
+// set by RAFT_SNAPSHOT_ENTRIES
+var raftSnapshotEntries = 1000
+
+func raft_log_path() string {
+	return filepath.Join(data_dir(), "raft.log")
+}
+
+// the entry at index, which has to be in the log
+func (n *raftNode) entry(index uint64) raftEntry {
+	return n.log[index-n.base]
+}
+
+// the term of the entry at index, the one compacted last included
+func (n *raftNode) term_at(index uint64) uint64 {
+	return n.log[index-n.base].Term
+}
+
+// the entries from index up to end, copied
+func (n *raftNode) entries(index uint64, end uint64) []raftEntry {
+	return append([]raftEntry(nil), n.log[index-n.base:end-n.base]...)
+}
+
+// drops the entries from index on, must be called with mu held
+func (n *raftNode) truncate(index uint64) {
+	n.log = n.log[:index-n.base]
+}
+
+// picks up the saved log if it belongs to the same group, otherwise
+// starts a new file for this one
+func (n *raftNode) restore() {
+	f, err := os.OpenFile(n.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Printf("raft: %v\n", err)
+		n.path = ""
+		return
+	}
+	dec := json.NewDecoder(f)
+	var good int64
+	ours := false
+	for {
+		var rec raftRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//torn by a crash halfway through a write, it was never fsynced
+			fmt.Printf("raft: dropping torn record at offset %d: %v\n", good, err)
+			break
+		}
+		if !ours {
+			//the file starts with the group it's for
+			if rec.Op != "group" || !n.same_group(rec.Epoch, rec.RequestID) {
+				break
+			}
+			ours = true
+		}
+		good = dec.InputOffset()
+		switch rec.Op {
+		case "group":
+			n.base = rec.Base
+			n.log = []raftEntry{{Term: rec.BaseTerm}}
+		case "state":
+			n.term = rec.Term
+			n.votedFor = rec.VotedFor
+		case "entry":
+			if rec.Entry == nil || rec.Index <= n.base || rec.Index > n.last_index()+1 {
+				continue
+			}
+			n.truncate(rec.Index)
+			n.log = append(n.log, *rec.Entry)
+		case "applied":
+			if rec.Applied > n.applied && rec.Applied <= n.last_index() {
+				n.applied = rec.Applied
+			}
+		}
+	}
+	f.Close()
+	if n.applied < n.base {
+		n.applied = n.base
+	}
+	n.commit = n.applied
+	if !ours {
+		n.rewrite()
+		return
+	}
+	if err := os.Truncate(n.path, good); err != nil {
+		fmt.Printf("raft: %v\n", err)
+	}
+	n.disk, err = os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Printf("raft: %v\n", err)
+	}
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+}
+
+// appends records to the log, fsyncing them if sync is set.
+// Must be called with mu held
+func (n *raftNode) write(sync bool, records ...raftRecord) {
+	if n.disk == nil {
+		return
+	}
+	data := []byte{}
+	for _, rec := range records {
+		line, _ := json.Marshal(rec)
+		data = append(append(data, line...), '\n')
+	}
+	_, err := n.disk.Write(data)
+	if err == nil && sync {
+		err = n.disk.Sync()
+	}
+	if err != nil {
+		fmt.Printf("raft: %v\n", err)
+	}
+}
+
+// saves the term and vote if they changed, must be called with mu held
+func (n *raftNode) persist() {
+	if n.term == n.savedTerm && n.votedFor == n.savedVote {
+		return
+	}
+	n.write(true, raftRecord{Op: "state", Term: n.term, VotedFor: n.votedFor})
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+}
+
+// saves the entries from index on, they replace whatever the file had
+// there. Must be called with mu held
+func (n *raftNode) persist_entries(index uint64) {
+	records := []raftRecord{}
+	if n.term != n.savedTerm || n.votedFor != n.savedVote {
+		records = append(records, raftRecord{Op: "state", Term: n.term, VotedFor: n.votedFor})
+		n.savedTerm, n.savedVote = n.term, n.votedFor
+	}
+	for i := index; i <= n.last_index(); i++ {
+		e := n.entry(i)
+		records = append(records, raftRecord{Op: "entry", Index: i, Entry: &e})
+	}
+	n.write(true, records...)
+}
+
+// notes how far the log was applied so a restart doesn't apply it again.
+// The store's writes for the entries are fsynced first, so the index on
+// disk never gets ahead of what the store has; a crash in between only
+// applies the last entries again (see apply_command). Compacts the log
+// once enough entries are applied. Must be called with mu held
+func (n *raftNode) persist_applied() {
+	if err := engine.Sync(); err != nil {
+		fmt.Printf("storage: %v\n", err)
+		return
+	}
+	n.write(true, raftRecord{Op: "applied", Applied: n.applied})
+	if n.applied-n.base >= uint64(raftSnapshotEntries) {
+		n.compact(n.applied)
+	}
+}
+
+// drops the entries up to index, they have to be applied already.
+// Must be called with mu held
+func (n *raftNode) compact(index uint64) {
+	if index <= n.base || index > n.applied {
+		return
+	}
+	//copied so the dropped entries can be freed
+	n.log = append([]raftEntry{{Term: n.term_at(index)}}, n.log[index-n.base+1:]...)
+	n.base = index
+	n.rewrite()
+}
+
+// writes the whole file again from what is in memory and swaps it in,
+// must be called with mu held
+func (n *raftNode) rewrite() {
+	if n.path == "" {
+		return
+	}
+	records := []raftRecord{
+		{Op: "group", Epoch: n.epoch, RequestID: n.requestID, Base: n.base, BaseTerm: n.term_at(n.base)},
+		{Op: "state", Term: n.term, VotedFor: n.votedFor},
+	}
+	for i := n.base + 1; i <= n.last_index(); i++ {
+		e := n.entry(i)
+		records = append(records, raftRecord{Op: "entry", Index: i, Entry: &e})
+	}
+	records = append(records, raftRecord{Op: "applied", Applied: n.applied})
+	err := write_records(n.path, records)
+	if err != nil {
+		fmt.Printf("raft: %v\n", err)
+		return
+	}
+	if n.disk != nil {
+		n.disk.Close()
+	}
+	n.disk, err = os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Printf("raft: %v\n", err)
+	}
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+}
+
+// writes records to a new file at path, fsynced and renamed into place
+func write_records(path string, records []raftRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	sync_dir(filepath.Dir(path))
+	return nil
+}
+
+// closes the file when the group is replaced
+func (n *raftNode) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.disk != nil {
+		n.disk.Close()
+		n.disk = nil
+	}
+}
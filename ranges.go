@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"138_assignment2/partition"
+)
+
+// Range-partitioned keyspaces. PUT /kvs/admin/keyspace with a prefix and
+// mode "range" makes every key under that prefix be placed by contiguous
+// ranges instead of by hash. The ranges are part of the view, so creating
+// a keyspace or splitting one of its ranges is a view change like any
+// other: it gets a new epoch, spreads with the view gossip, and the
+// rebalancer moves the keys that changed shards. The first live replica
+// of each shard checks its ranges every RANGE_CHECK_INTERVAL seconds and
+// splits the ones holding more than RANGE_SPLIT_KEYS keys at their median,
+// handing the upper half to the shard with the fewest ranges.
+var rangeSplitKeys = 10000
+var rangeCheckInterval = 10 * time.Second
+
+// what an admin sends to /kvs/admin/keyspace
+type keyspaceRequest struct {
+	Prefix string `json:"prefix"`
+	Mode   string `json:"mode"`
+}
+
+func load_ranges() {
+	rangeSplitKeys = env_int("RANGE_SPLIT_KEYS", rangeSplitKeys)
+	rangeCheckInterval = env_duration("RANGE_CHECK_INTERVAL", time.Second, rangeCheckInterval)
+}
+
+// installs a view with the same nodes and the given keyspaces, the same
+// way an admin changing the view would
+func propose_keyspaces(v viewState, keyspaces []partition.Keyspace) error {
+	body, _ := json.Marshal(Shards{Shard: v.current.Shard, Nodes: v.current.Nodes, Keyspaces: keyspaces})
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	r, _ := http.NewRequest("PUT", "http://"+os.Getenv("ADDRESS")+"/kvs/admin/view", bytes.NewReader(body))
+	r.Header.Add("Content-Type", "application/json")
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("view change refused with %d", response.StatusCode)
+	}
+	return nil
+}
+
+// handler for creating a keyspace
+func create_keyspace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	v := load_view()
+	if !v.inView || v.current.Shard == 0 {
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	var req keyspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	for _, ks := range v.current.Keyspaces {
+		if ks.Prefix == req.Prefix {
+			//already there, a retry changes nothing
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(ks)
+			return
+		}
+	}
+	//starts out on whichever shard the prefix itself hashes to
+	ks, err := partition.NewKeyspace(req.Prefix, req.Mode, partitioner_for(v.current.Shard).Shard(req.Prefix))
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	next := append(append([]partition.Keyspace{}, v.current.Keyspaces...), ks)
+	if err := propose_keyspaces(v, next); err != nil {
+		w.WriteHeader(503)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(ks)
+}
+
+// the shard with the fewest ranges of the keyspace, not counting self
+// unless it's the only one
+func least_loaded(ks partition.Keyspace, shards int, self int) int {
+	counts := make([]int, shards)
+	for _, rg := range ks.Ranges {
+		counts[rg.Shard%shards]++
+	}
+	best := -1
+	for shard, n := range counts {
+		if shard == self && shards > 1 {
+			continue
+		}
+		if best < 0 || n < counts[best] {
+			best = shard
+		}
+	}
+	return best
+}
+
+// the live keys of range i of the keyspace, in order
+func range_keys(v viewState, ks partition.Keyspace, i int) []string {
+	end, bounded := ks.Ranges.End(i)
+	start := ks.Ranges[i].Start
+	keys := []string{}
+	now := time.Now()
+	store.Ascend(start, func(item KVS) bool {
+		if bounded && item.Key >= end {
+			return false
+		}
+		if !present(item, true, now) {
+			return true
+		}
+		//keys of a keyspace nested inside this one aren't in its ranges
+		if owner := partition.FindKeyspace(v.current.Keyspaces, item.Key); owner == nil || owner.Prefix != ks.Prefix {
+			return true
+		}
+		keys = append(keys, item.Key)
+		return true
+	})
+	return keys
+}
+
+// splits at most one range this shard owns that has grown too big
+func check_splits() {
+	v := load_view()
+	if !v.inView || v.current.Shard == 0 || v.selfID < 0 || len(v.current.Keyspaces) == 0 {
+		return
+	}
+	//one replica per shard decides, and not while keys are still moving
+	nodes := live_first(v.shards[v.selfID].Node)
+	if len(nodes) == 0 || nodes[0] != os.Getenv("ADDRESS") || rebalance.running() {
+		return
+	}
+	for k, ks := range v.current.Keyspaces {
+		if !ks.Ranged() {
+			continue
+		}
+		for i, rg := range ks.Ranges {
+			if rg.Shard%v.current.Shard != v.selfID {
+				continue
+			}
+			keys := range_keys(v, ks, i)
+			if len(keys) <= rangeSplitKeys {
+				continue
+			}
+			at := keys[len(keys)/2]
+			ranges, err := ks.Ranges.Split(at, least_loaded(ks, v.current.Shard, v.selfID))
+			if err != nil {
+				continue
+			}
+			next := append([]partition.Keyspace{}, v.current.Keyspaces...)
+			next[k].Ranges = ranges
+			if err := propose_keyspaces(v, next); err != nil {
+				fmt.Printf("range split at %q failed: %v\n", at, err)
+			}
+			return
+		}
+	}
+}
+
+func start_ranges() {
+	go func() {
+		for {
+			time.Sleep(rangeCheckInterval)
+			check_splits()
+		}
+	}()
+}
+
+// handler for GET /kvs/scan, the keys from "from" up to "to" in order.
+// Takes the same limit, cursor and values ("true" unless set to
+// "false") as /kvs/keys
+func scan_keys(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	w.Header().Set("Content-Type", "application/json")
+	if !v.inView || v.current.Shard == 0 {
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	params := r.URL.Query()
+	q, ok := parse_list_query(params)
+	if !ok || (q.To != "" && q.From > q.To) {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad query"})
+		return
+	}
+	q.Values = params.Get("values") != "false"
+
+	ks := scan_keyspace(v, q)
+	if ks == nil {
+		//hash placed keys can be anywhere, ask everyone
+		list_all(w, v, q)
+		return
+	}
+
+	//walk the ranges in order, only asking the shards that own them
+	start := q.From
+	if q.StartAfter > start {
+		start = q.StartAfter
+	}
+	entries := []ListEntry{}
+	more := false
+	for i := ks.Ranges.Find(start); i < len(ks.Ranges) && ks.Ranges[i].Start < q.To; i++ {
+		sub := q
+		sub.Limit = q.Limit - len(entries)
+		if ks.Ranges[i].Start > sub.From {
+			sub.From = ks.Ranges[i].Start
+		}
+		if end, bounded := ks.Ranges.End(i); bounded && end < sub.To {
+			sub.To = end
+		}
+		upstream := v.shards[ks.Ranges[i].Shard%v.current.Shard]
+		got, ok := list_shard_of(v, upstream, sub)
+		if !ok {
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(struct {
+				Error    string     `json:"error"`
+				Upstream NodeShards `json:"upstream"`
+			}{"upstream down", upstream})
+			return
+		}
+		entries = append(entries, got...)
+		if len(entries) >= q.Limit {
+			more = true
+			break
+		}
+	}
+	list_page(w, q, entries, more)
+}
+
+// the range keyspace a scan stays inside of, nil if it doesn't
+// stay inside of one or another keyspace is nested in it
+func scan_keyspace(v viewState, q listQuery) *partition.Keyspace {
+	if q.To == "" {
+		return nil
+	}
+	ks := partition.FindKeyspace(v.current.Keyspaces, q.From)
+	if ks == nil || !strings.HasPrefix(q.To, ks.Prefix) {
+		return nil
+	}
+	for _, other := range v.current.Keyspaces {
+		if other.Prefix != ks.Prefix && strings.HasPrefix(other.Prefix, ks.Prefix) {
+			return nil
+		}
+	}
+	return ks
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Moves keys to their new shard after the view changes. Every node works
+// out which of its keys belong to another shard now and streams them to
+// that shard's replicas in batches. A key is only dropped locally once
+// enough of the new owners have acked it, batches that don't get through
+// are retried with backoff, and whatever is left gets picked up again on
+// the next pass.
+const (
+	RebalanceIdle    = "idle"
+	RebalanceRunning = "running"
+	RebalanceDone    = "done"
+	RebalanceFailed  = "failed"
+)
+
+// what GET /kvs/admin/rebalance answers with
+type RebalanceStatus struct {
+	State string `json:"state"`
+	//the view the last pass moved keys for
+	ViewEpoch uint64 `json:"view_epoch"`
+	//true when this node left the view and is handing everything over
+	Handoff  bool                       `json:"handoff"`
+	Started  time.Time                  `json:"started"`
+	Finished time.Time                  `json:"finished"`
+	Planned  int                        `json:"planned"`
+	Moved    int                        `json:"moved"`
+	Pending  int                        `json:"pending"`
+	Failed   int                        `json:"failed"`
+	Batches  int                        `json:"batches"`
+	Retries  int                        `json:"retries"`
+	Shards   map[int]*RebalanceProgress `json:"shards"`
+	Errors   []string                   `json:"errors"`
+}
+
+// how far along the keys going to one shard are
+type RebalanceProgress struct {
+	Planned   int    `json:"planned"`
+	Moved     int    `json:"moved"`
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// one batch of keys sent to a replica of their new shard
+type rebalanceBatch struct {
+	Epoch     uint64 `json:"epoch"`
+	RequestID string `json:"request_id"`
+	Keys      []KVS  `json:"keys"`
+}
+
+type rebalancer struct {
+	mu     sync.Mutex
+	status RebalanceStatus
+	//the view to give every key to once this node is removed
+	handoff *Shards
+	//the epoch of the last view a pass found nothing left to move for
+	settled uint64
+	//nodes that left the view and might still be handing keys over
+	departed map[string]bool
+	wake     chan struct{}
+}
+
+// what a node says when asked whether it still has keys to move
+type movingAnswer struct {
+	Moving bool   `json:"moving"`
+	Epoch  uint64 `json:"epoch"`
+}
+
+// knobs, set by REBALANCE_BATCH (keys), REBALANCE_RETRIES,
+// REBALANCE_BACKOFF (milliseconds) and REBALANCE_INTERVAL (seconds)
+var rebalanceBatchSize = 100
+var rebalanceRetries = 10
+var rebalanceBackoff = 100 * time.Millisecond
+var rebalanceInterval = 10 * time.Second
+
+// the backoff between retries doubles up to this
+const maxRebalanceBackoff = 5 * time.Second
+
+// only the last few errors are kept for the status
+const maxRebalanceErrors = 10
+
+var rebalance = &rebalancer{
+	status:   RebalanceStatus{State: RebalanceIdle, Shards: map[int]*RebalanceProgress{}, Errors: []string{}},
+	departed: make(map[string]bool),
+	wake:     make(chan struct{}, 1),
+}
+
+func load_rebalance() {
+	rebalanceBatchSize = env_int("REBALANCE_BATCH", rebalanceBatchSize)
+	rebalanceRetries = env_int("REBALANCE_RETRIES", rebalanceRetries)
+	rebalanceBackoff = env_duration("REBALANCE_BACKOFF", time.Millisecond, rebalanceBackoff)
+	rebalanceInterval = env_duration("REBALANCE_INTERVAL", time.Second, rebalanceInterval)
+}
+
+// starts a pass soon, doesn't block
+func (b *rebalancer) trigger() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// the view changed and this node is (still) in it, gone are the nodes
+// that were taken out of it
+func (b *rebalancer) view_changed(gone []string) {
+	b.mu.Lock()
+	b.handoff = nil
+	for _, node := range gone {
+		if node != os.Getenv("ADDRESS") {
+			b.departed[node] = true
+		}
+	}
+	b.mu.Unlock()
+	b.trigger()
+}
+
+// whether a pass is moving keys right now
+func (b *rebalancer) running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status.State == RebalanceRunning
+}
+
+// whether keys could still move off this node: it's handing them off,
+// a pass is running or failed, or none has run yet for the view it has
+func (b *rebalancer) moving() bool {
+	v := load_view()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handoff != nil || b.status.State == RebalanceRunning {
+		return true
+	}
+	return v.inView && b.settled != v.current.Epoch
+}
+
+func (b *rebalancer) departed_nodes() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nodes := []string{}
+	for node := range b.departed {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// a node that left the view has nothing left to hand over
+func (b *rebalancer) handed_off(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.departed, node)
+}
+
+// this node was taken out of the view, every key it has goes to next
+func (b *rebalancer) hand_off(next Shards) {
+	b.mu.Lock()
+	b.handoff = &next
+	b.mu.Unlock()
+	b.trigger()
+}
+
+// the view keys get moved to, and which shard in it is ours
+// (-1 when handing off, so every key moves)
+func (b *rebalancer) target() (Shards, int, bool, bool) {
+	b.mu.Lock()
+	handoff := b.handoff
+	b.mu.Unlock()
+	if handoff != nil {
+		return *handoff, -1, true, true
+	}
+	v := load_view()
+	if !v.inView {
+		return Shards{}, 0, false, false
+	}
+	return v.current, v.selfID, false, true
+}
+
+// checks the view a pass started on is still the one to move keys for
+func (b *rebalancer) still_current(view Shards, handoff bool) bool {
+	if handoff {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.handoff != nil && same_view(*b.handoff, view)
+	}
+	v := load_view()
+	return v.inView && same_view(v.current, view)
+}
+
+// the keys this node has that belong to another shard, by shard
+func make_plan(view Shards, self int) map[int][]KVS {
+	plan := make(map[int][]KVS)
+	store.Range(func(item KVS) bool {
+		if shard := shard_of(item.Key, view); shard != self {
+			plan[shard] = append(plan[shard], item)
+		}
+		return true
+	})
+	return plan
+}
+
+// one pass: plan against the current view and stream every shard's keys
+func (b *rebalancer) run() {
+	view, self, handoff, ok := b.target()
+	if !ok {
+		return
+	}
+	plan := make_plan(view, self)
+	if len(plan) == 0 {
+		if handoff {
+			b.finish_handoff(view)
+		}
+		b.mu.Lock()
+		if !handoff {
+			b.settled = view.Epoch
+		}
+		if b.status.State == RebalanceFailed {
+			//whatever failed has moved since, or is gone
+			b.status.State = RebalanceDone
+			b.status.Pending = 0
+		}
+		b.mu.Unlock()
+		return
+	}
+
+	b.begin(view, handoff, plan)
+	groups, err := groups_of(view)
+	if err != nil {
+		b.record_error(-1, err.Error())
+		b.end()
+		return
+	}
+	var wg sync.WaitGroup
+	for shard, keys := range plan {
+		wg.Add(1)
+		go func(shard int, keys []KVS) {
+			defer wg.Done()
+			b.move_shard(view, handoff, shard, groups[shard], keys)
+		}(shard, keys)
+	}
+	wg.Wait()
+	b.end()
+	if handoff && len(make_plan(view, self)) == 0 {
+		b.finish_handoff(view)
+	}
+}
+
+// streams the keys for one shard, batch by batch
+func (b *rebalancer) move_shard(view Shards, handoff bool, shard int, nodes []string, keys []KVS) {
+	for start := 0; start < len(keys); start += rebalanceBatchSize {
+		end := start + rebalanceBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		if !b.send_batch(view, handoff, shard, nodes, batch) {
+			b.failed(shard, len(keys)-start)
+			return
+		}
+		//the new owners have it, drop ours unless it was written to since
+		for _, item := range batch {
+			err := store.RemoveIf(item.Key, func(local KVS) bool {
+				return same_kvs(local, item)
+			})
+			if err != nil {
+				fmt.Printf("storage: %v\n", err)
+			}
+		}
+		b.moved(shard, len(batch))
+	}
+}
+
+// sends a batch until enough of the shard's replicas ack it,
+// backing off between tries
+func (b *rebalancer) send_batch(view Shards, handoff bool, shard int, nodes []string, batch []KVS) bool {
+	backoff := rebalanceBackoff
+	for attempt := 0; attempt <= rebalanceRetries; attempt++ {
+		if attempt > 0 {
+			b.retried()
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxRebalanceBackoff {
+				backoff = maxRebalanceBackoff
+			}
+		}
+		if !b.still_current(view, handoff) {
+			//the next pass plans against the new view
+			return false
+		}
+		live := live_first(nodes)
+		need := required(writeConsistency, len(nodes))
+		acks, err := push_batch(view, live, batch)
+		if acks >= need && acks > 0 {
+			return true
+		}
+		if err == "" {
+			err = fmt.Sprintf("%d of %d replicas acked, need %d", acks, len(nodes), need)
+		}
+		b.record_error(shard, err)
+	}
+	return false
+}
+
+// sends the batch to every node at once and counts the acks
+func push_batch(view Shards, nodes []string, batch []KVS) (int, string) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	type result struct {
+		ok      bool
+		address string
+	}
+	results := make(chan result, len(nodes))
+	for _, address := range nodes {
+		go func(address string) {
+			var ack map[string]int
+			ok := put_json(&client, "http://"+address+"/rebalance", rebalanceBatch{view.Epoch, view.RequestID, batch}, &ack)
+			results <- result{ok, address}
+		}(address)
+	}
+	acks := 0
+	last := ""
+	for range nodes {
+		res := <-results
+		if res.ok {
+			acks++
+		} else {
+			last = res.address + " did not take the batch"
+		}
+	}
+	return acks, last
+}
+
+// drops everything once it has all been handed over, unless the node
+// got added back in the meantime
+func (b *rebalancer) finish_handoff(view Shards) {
+	viewMu.Lock()
+	defer viewMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if inView || b.handoff == nil || !same_view(*b.handoff, view) {
+		return
+	}
+	b.handoff = nil
+	if err := store.Clear(); err != nil {
+		fmt.Printf("storage: %v\n", err)
+	}
+}
+
+func (b *rebalancer) begin(view Shards, handoff bool, plan map[int][]KVS) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.State = RebalanceRunning
+	b.status.ViewEpoch = view.Epoch
+	b.status.Handoff = handoff
+	b.status.Started = time.Now()
+	b.status.Finished = time.Time{}
+	b.status.Planned, b.status.Moved, b.status.Pending, b.status.Failed = 0, 0, 0, 0
+	b.status.Batches, b.status.Retries = 0, 0
+	b.status.Shards = map[int]*RebalanceProgress{}
+	for shard, keys := range plan {
+		b.status.Shards[shard] = &RebalanceProgress{Planned: len(keys)}
+		b.status.Planned += len(keys)
+	}
+	b.status.Pending = b.status.Planned
+}
+
+func (b *rebalancer) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Finished = time.Now()
+	if b.status.Failed > 0 {
+		b.status.State = RebalanceFailed
+	} else {
+		b.status.State = RebalanceDone
+	}
+}
+
+func (b *rebalancer) moved(shard int, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Moved += n
+	b.status.Pending -= n
+	b.status.Batches++
+	if p, ok := b.status.Shards[shard]; ok {
+		p.Moved += n
+	}
+}
+
+func (b *rebalancer) failed(shard int, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Failed += n
+	b.status.Pending -= n
+	if p, ok := b.status.Shards[shard]; ok {
+		p.Failed += n
+	}
+}
+
+func (b *rebalancer) retried() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Retries++
+}
+
+func (b *rebalancer) record_error(shard int, err string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p, ok := b.status.Shards[shard]; ok {
+		p.LastError = err
+	}
+	b.status.Errors = append(b.status.Errors, fmt.Sprintf("%s shard %d: %s", time.Now().Format(time.RFC3339), shard, err))
+	if len(b.status.Errors) > maxRebalanceErrors {
+		b.status.Errors = b.status.Errors[len(b.status.Errors)-maxRebalanceErrors:]
+	}
+}
+
+// takes a batch of keys that now belong to this node's shard
+func rebalance_batch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var batch rebalanceBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	//only take keys planned against the view we have, the sender
+	//retries until gossip brings one of us up to date
+	view := load_view()
+	if !view.inView || !same_view(view.current, Shards{Epoch: batch.Epoch, RequestID: batch.RequestID}) {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(map[string]string{"error": "view mismatch"})
+		return
+	}
+	for _, item := range batch.Keys {
+		if linearizable(item.Key) {
+			//has to be in the shard's log before we can ack it
+			item := item
+			if err := raft_submit(raftCommand{Op: "merge", Key: item.Key, KVS: &item}); err != nil {
+				w.WriteHeader(503)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			continue
+		}
+		if _, err := merge_replica(item); err != nil {
+			storage_error(w, err)
+			return
+		}
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(map[string]int{"merged": len(batch.Keys)})
+}
+
+// handler for a node asking whether this one still has keys to move
+func moving_keys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(movingAnswer{rebalance.moving(), load_view().current.Epoch})
+}
+
+// shows how the last pass went
+func get_rebalance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rebalance.mu.Lock()
+	defer rebalance.mu.Unlock()
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(rebalance.status)
+}
+
+// runs a pass whenever the view changes, and every so often
+// to retry whatever didn't make it
+func start_rebalancer() {
+	go func() {
+		t := time.NewTicker(rebalanceInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-rebalance.wake:
+			case <-t.C:
+			}
+			rebalance.run()
+		}
+	}()
+	rebalance.trigger()
+}
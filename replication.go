@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+	"github.com/gorilla/mux"
+)
+
+// what a client sends to /kvs/data/{key}
+type DataRequest struct {
+	Value  string        `json:"val"`
+	Vector CausalContext `json:"causal-metadata"`
+	//ONE, QUORUM or ALL, falls back to the cluster default
+	Consistency string `json:"consistency,omitempty"`
+	//in sibling mode, the context of the values this write replaces
+	Context vclock.VClock `json:"context,omitempty"`
+	//only write if the key still is what the client expects
+	Condition
+	//seconds until the key expires, it never does when left out
+	TTL int `json:"ttl,omitempty"`
+}
+
+// what a request on /kvs/data/{key} answers with. The handlers write it
+// out, a batch runs the same code for each of its operations and keeps it
+type dataResult struct {
+	status int
+	//encoded as JSON, or sent as is when it's already []byte
+	body interface{}
+	//where a 307 sends the client
+	location string
+}
+
+func answer_with(status int, body interface{}) dataResult {
+	return dataResult{status: status, body: body}
+}
+
+// the JSON of the body
+func (res dataResult) encoded() []byte {
+	if raw, ok := res.body.([]byte); ok {
+		return raw
+	}
+	data, _ := json.Marshal(res.body)
+	return data
+}
+
+func (res dataResult) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if res.location != "" {
+		w.Header().Set("Location", res.location)
+	}
+	w.WriteHeader(res.status)
+	if raw, ok := res.body.([]byte); ok {
+		w.Write(raw)
+		return
+	}
+	json.NewEncoder(w).Encode(res.body)
+}
+
+// how many replicas of the shard have to answer
+const (
+	ConsistencyOne    = "ONE"
+	ConsistencyQuorum = "QUORUM"
+	ConsistencyAll    = "ALL"
+)
+
+// cluster defaults, set by WRITE_CONSISTENCY and READ_CONSISTENCY
+var writeConsistency = ConsistencyOne
+var readConsistency = ConsistencyOne
+
+// how long the coordinator waits on the other replicas, set by
+// QUORUM_TIMEOUT in seconds
+var quorumTimeout = 5 * time.Second
+
+func load_consistency() {
+	if level, ok := consistency_level(os.Getenv("WRITE_CONSISTENCY"), writeConsistency); ok {
+		writeConsistency = level
+	}
+	if level, ok := consistency_level(os.Getenv("READ_CONSISTENCY"), readConsistency); ok {
+		readConsistency = level
+	}
+	quorumTimeout = env_duration("QUORUM_TIMEOUT", time.Second, quorumTimeout)
+	readRepairWindow = env_duration("READ_REPAIR_WINDOW", time.Millisecond, readRepairWindow)
+}
+
+// checks the requested level, an empty one means the default
+func consistency_level(requested string, def string) (string, bool) {
+	switch strings.ToUpper(requested) {
+	case "":
+		return def, true
+	case ConsistencyOne:
+		return ConsistencyOne, true
+	case ConsistencyQuorum:
+		return ConsistencyQuorum, true
+	case ConsistencyAll:
+		return ConsistencyAll, true
+	}
+	return "", false
+}
+
+// how many of the n replicas (this node included) have to answer
+func required(level string, n int) int {
+	switch level {
+	case ConsistencyAll:
+		return n
+	case ConsistencyQuorum:
+		return n/2 + 1
+	}
+	return 1
+}
+
+// the other nodes in this node's shard
+func shard_peers(v viewState) []string {
+	peers := []string{}
+	if v.selfID < 0 || v.selfID >= len(v.shards) {
+		return peers
+	}
+	for _, node := range v.shards[v.selfID].Node {
+		if node != os.Getenv("ADDRESS") {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// sends a version of a key to the other replicas and waits for need-1 of
+// them to store it (this node already has it). Gives back how many
+// replicas have it, this node included.
+func replicate(item KVS, peers []string, need int) int {
+	acks := 1
+	peers = live_first(peers)
+	if need <= acks || len(peers)+1 < need {
+		return acks
+	}
+	body, _ := json.Marshal(item)
+	done := make(chan bool, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			client := http.Client{
+				Timeout: quorumTimeout,
+			}
+			r, _ := http.NewRequest("PUT", "http://"+address+"/replica/"+item.Key, bytes.NewReader(body))
+			r.Header.Add("Content-Type", "application/json")
+			with_epoch(r)
+			response, err := client.Do(r)
+			if err != nil {
+				done <- false
+				return
+			}
+			response.Body.Close()
+			done <- response.StatusCode == 200
+		}(address)
+	}
+
+	deadline := time.NewTimer(quorumTimeout)
+	defer deadline.Stop()
+	for answered := 0; answered < len(peers) && acks < need; answered++ {
+		select {
+		case ok := <-done:
+			if ok {
+				acks++
+			}
+		case <-deadline.C:
+			return acks
+		}
+	}
+	return acks
+}
+
+// what a replica said it has for a key
+type answer struct {
+	address string
+	item    KVS
+	found   bool
+	ok      bool
+	//the 409 of a replica that has a newer view
+	refused []byte
+}
+
+// asks need-1 other replicas for their version of the key and merges
+// them with the local one. Gives back the newest version, whether any
+// replica had the key and how many replicas answered.
+func read_quorum(key string, local KVS, found bool, peers []string, need int) (KVS, bool, int) {
+	answers := 1
+	peers = live_first(peers)
+	if need <= answers || len(peers)+1 < need {
+		return local, found, answers
+	}
+	done := make(chan answer, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			item, found, err := fetch_replica(address, key, nil, quorumTimeout)
+			done <- answer{address, item, found, err == nil, nil}
+		}(address)
+	}
+
+	merged := local
+	seen := map[string]answer{}
+	deadline := time.NewTimer(quorumTimeout)
+	defer deadline.Stop()
+wait:
+	for answered := 0; answered < len(peers) && answers < need; answered++ {
+		select {
+		case a := <-done:
+			if !a.ok {
+				continue
+			}
+			answers++
+			seen[a.address] = a
+			if !a.found {
+				continue
+			}
+			if !found {
+				merged = a.item
+			} else {
+				merged = combine(merged, a.item)
+			}
+			found = true
+		case <-deadline.C:
+			break wait
+		}
+	}
+
+	//fix up whoever answered with something older, this node included
+	if found {
+		stale := []string{}
+		for address, a := range seen {
+			if !a.found || !same_kvs(a.item, merged) {
+				stale = append(stale, address)
+			}
+		}
+		read_repair(merged, stale)
+		if !same_kvs(local, merged) {
+			merge_replica(merged)
+		}
+	}
+	return merged, found, answers
+}
+
+// a replica refused a request because it has a newer view than ours,
+// body is its answer with that view
+type staleViewError struct {
+	address string
+	body    []byte
+}
+
+func (e *staleViewError) Error() string {
+	return fmt.Sprintf("replica %s has a newer view", e.address)
+}
+
+// gets the full version of a key from another replica. If causal metadata
+// is given the replica waits until it has caught up to it first
+func fetch_replica(address string, key string, ctx CausalContext, timeout time.Duration) (KVS, bool, error) {
+	client := http.Client{
+		Timeout: timeout,
+	}
+	view_marshalled, _ := json.Marshal(DataRequest{Vector: ctx})
+	r, _ := http.NewRequest("GET", "http://"+address+"/replica/"+key, bytes.NewReader(view_marshalled))
+	r.Header.Add("Content-Type", "application/json")
+	with_epoch(r)
+	response, err := client.Do(r)
+	if err != nil {
+		return KVS{}, false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == 404 {
+		return KVS{}, false, nil
+	}
+	if response.StatusCode == http.StatusConflict {
+		body, _ := io.ReadAll(response.Body)
+		return KVS{}, false, &staleViewError{address, body}
+	}
+	if response.StatusCode != 200 {
+		return KVS{}, false, fmt.Errorf("replica %s answered %d", address, response.StatusCode)
+	}
+	var item KVS
+	if err := json.NewDecoder(response.Body).Decode(&item); err != nil {
+		return KVS{}, false, err
+	}
+	return item, true, nil
+}
+
+// keeps whichever version is newer, same rule the gossip uses
+func merge_replica(sent KVS) (KVS, error) {
+	clock.observe(sent.HLC)
+	return store.Update(sent.Key, func(local KVS, found bool) (KVS, bool) {
+		if !found {
+			//a tombstone for it was collected, this can't be newer
+			if tombstones.covers(sent.Key, sent.Vector) {
+				return local, false
+			}
+			return sent, true
+		}
+		next := combine(local, sent)
+		return next, !same_kvs(next, local)
+	})
+}
+
+// handler for the coordinator pushing or pulling a single key
+func handle_replica(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	k := mux.Vars(r)["key"]
+	if !check_epoch(w, r, load_view()) {
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodGet:
+		var req DataRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Vector) > 0 && !wait_for_version(r.Context(), req.Vector, load_view()) {
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(map[string]string{"error": "timed out while waiting for depended updates"})
+			return
+		}
+		item, ok := store.Get(k)
+		if !ok {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(item)
+
+	case http.MethodPut:
+		var sent KVS
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil || sent.Key != k {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+			return
+		}
+		if _, err := merge_replica(sent); err != nil {
+			storage_error(w, err)
+			return
+		}
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(map[string]string{"result": "ok"})
+	}
+}
+
+// how long a read that was forwarded to another shard keeps collecting
+// answers after the first one, set by READ_REPAIR_WINDOW in milliseconds
+var readRepairWindow = 200 * time.Millisecond
+
+// reads a key that lives on another shard. Every replica of that shard is
+// asked, the answers that come in within readRepairWindow of the first one
+// are merged and the newest version goes back to the client and to every
+// replica that had something older.
+func read_fan_out(k string, req DataRequest, level string, upstream NodeShards) dataResult {
+	//the replicas wait for the client's dependencies, so give them the
+	//whole causal timeout before we call them down
+	timeout := causalTimeout + time.Second
+	need := required(level, len(upstream.Node))
+	nodes := live_first(upstream.Node)
+	if len(nodes) < need {
+		//known-dead replicas won't answer, don't wait for them
+		return answer_with(503, struct {
+			Error    string     `json:"error"`
+			Upstream NodeShards `json:"upstream"`
+		}{"upstream down", upstream})
+	}
+	done := make(chan answer, len(nodes))
+	for _, eachAddress := range nodes {
+		go func(address string) {
+			item, found, err := fetch_replica(address, k, req.Vector, timeout)
+			var refused []byte
+			if stale, ok := err.(*staleViewError); ok {
+				refused = stale.body
+			}
+			done <- answer{address, item, found, err == nil, refused}
+		}(eachAddress)
+	}
+
+	var newest KVS
+	found := false
+	answers := 0
+	var refused []byte
+	seen := map[string]answer{}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var window <-chan time.Time
+	pending := len(nodes)
+collect:
+	for pending > 0 {
+		select {
+		case a := <-done:
+			pending--
+			if a.refused != nil {
+				refused = a.refused
+			}
+			if !a.ok {
+				continue
+			}
+			answers++
+			seen[a.address] = a
+			if window == nil {
+				window = time.After(readRepairWindow)
+			}
+			if a.found && !found {
+				newest = a.item
+				found = true
+			} else if a.found {
+				newest = combine(newest, a.item)
+			}
+		case <-window:
+			if answers >= need {
+				break collect
+			}
+			//keep going until enough replicas have answered
+			window = nil
+		case <-deadline.C:
+			break collect
+		}
+	}
+
+	//the key might not be on that shard anymore, the client gets the
+	//newer view back the same way forward_to relays it
+	if refused != nil {
+		return answer_with(http.StatusConflict, refused)
+	}
+	if answers == 0 {
+		return answer_with(503, struct {
+			Error    string     `json:"error"`
+			Upstream NodeShards `json:"upstream"`
+		}{"upstream down", upstream})
+	}
+	if answers < need {
+		return answer_with(503, struct {
+			Error    string `json:"error"`
+			Answers  int    `json:"answers"`
+			Required int    `json:"required"`
+		}{"not enough replicas", answers, need})
+	}
+
+	if found {
+		stale := []string{}
+		for _, address := range upstream.Node {
+			if a, ok := seen[address]; !ok || !a.found || !same_kvs(a.item, newest) {
+				stale = append(stale, address)
+			}
+		}
+		read_repair(newest, stale)
+	}
+
+	if !present(newest, found, time.Now()) {
+		return answer_with(404, struct {
+			Version CausalContext `json:"causal-metadata"`
+		}{req.Vector})
+	}
+	ctx := req.Vector.with(upstream.Shard, newest.Vector)
+	if newest.CRDT != nil {
+		return crdt_answer(newest, ctx)
+	}
+	if siblings_for(k) {
+		return sibling_answer(newest, ctx)
+	}
+	return answer_with(200, struct {
+		Value   string        `json:"val"`
+		Clock   vclock.VClock `json:"clock"`
+		Version CausalContext `json:"causal-metadata"`
+	}{newest.Value, newest.Vector, ctx})
+}
+
+// pushes the newest version of a key to replicas that had an older one,
+// in the background so the read doesn't wait on it
+func read_repair(newest KVS, stale []string) {
+	if len(stale) == 0 {
+		return
+	}
+	body, _ := json.Marshal(newest)
+	for _, address := range stale {
+		go func(address string) {
+			client := http.Client{
+				Timeout: quorumTimeout,
+			}
+			r, _ := http.NewRequest("PUT", "http://"+address+"/replica/"+newest.Key, bytes.NewReader(body))
+			r.Header.Add("Content-Type", "application/json")
+			with_epoch(r)
+			response, err := client.Do(r)
+			if err != nil {
+				return
+			}
+			response.Body.Close()
+		}(address)
+	}
+}
+
+// sends a request to the nodes of the owning shard one at a time until one
+// of them answers, so exactly one replica coordinates it, and passes its
+// answer back to the client
+func forward_to(w http.ResponseWriter, method string, path string, req interface{}, upstream NodeShards) {
+	relay(method, path, req, upstream).write(w)
+}
+
+// what forward_to sends back, the answer of the first node that gave one
+func relay(method string, path string, req interface{}, upstream NodeShards) dataResult {
+	view_marshalled, _ := json.Marshal(req)
+	client := http.Client{
+		Timeout: time.Second * 20,
+		//the client follows a redirect itself, to the node it names
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	//skip the replicas the failure detector knows are dead
+	for _, address := range live_first(upstream.Node) {
+		r, _ := http.NewRequest(method, "http://"+address+path, bytes.NewReader(view_marshalled))
+		r.Header.Add("Content-Type", "application/json")
+		//if the owner has a newer view it refuses this and the
+		//client gets its view back from the relayed answer
+		with_epoch(r)
+		response, err := client.Do(r)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			continue
+		}
+		res := answer_with(response.StatusCode, body)
+		//a follower of a raft group sends the client on to its leader
+		res.location = response.Header.Get("Location")
+		return res
+	}
+	return answer_with(503, struct {
+		Error    string     `json:"error"`
+		Upstream NodeShards `json:"upstream"`
+	}{"upstream down", upstream})
+}
+
+// tells the client the write didn't reach enough replicas in time
+func quorum_failure(acks int, need int) dataResult {
+	return answer_with(503, struct {
+		Error    string `json:"error"`
+		Acks     int    `json:"acks"`
+		Required int    `json:"required"`
+	}{"not enough replicas", acks, need})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Sibling mode (SIBLINGS=true) keeps every one of a key's concurrent
+// values instead of letting the later Time win. Each value carries a
+// clock keyed by the replica that took the write. A GET answers with all
+// of the live values and a context merging their clocks, and a write
+// that sends that context back replaces everything it covers. Writes the
+// replicas didn't know about each other stay around as siblings until
+// the application resolves them that way.
+var siblingMode = false
+
+// one of the values a key holds
+type Sibling struct {
+	Value   string `json:"val"`
+	Deleted bool   `json:"deleted,omitempty"`
+	//the writes this value has seen, its own dot included
+	Clock vclock.VClock `json:"clock"`
+	Time  time.Time     `json:"time"`
+	HLC   HLC           `json:"hlc"`
+}
+
+func load_siblings() {
+	siblingMode = os.Getenv("SIBLINGS") == "true"
+}
+
+// whether the key keeps siblings, linearizable keys never have any
+func siblings_for(key string) bool {
+	return siblingMode && !linearizable(key)
+}
+
+// whether clock a has seen everything b has
+func descends(a vclock.VClock, b vclock.VClock) bool {
+	for id, ticks := range b {
+		if a[id] < ticks {
+			return false
+		}
+	}
+	return true
+}
+
+// the siblings of a stored version. One written before sibling mode was
+// on becomes a single sibling that any write with a context replaces
+func siblings_of(item KVS, found bool) []Sibling {
+	if !found {
+		return nil
+	}
+	if len(item.Siblings) > 0 {
+		return append([]Sibling(nil), item.Siblings...)
+	}
+	return []Sibling{{Value: item.Value, Deleted: item.Deleted, Clock: vclock.New(), Time: item.Time, HLC: item.HLC}}
+}
+
+// same order on every replica so equal sets hash and compare equal
+func sort_siblings(siblings []Sibling) {
+	sort.Slice(siblings, func(i, j int) bool {
+		a, b := siblings[i].Clock.ReturnVCString(), siblings[j].Clock.ReturnVCString()
+		if a != b {
+			return a < b
+		}
+		return siblings[i].Value < siblings[j].Value
+	})
+}
+
+// the newest live value, what a client that doesn't know about
+// siblings gets to see. The key is deleted when none of them are live
+func newest_value(siblings []Sibling) (string, bool) {
+	value := ""
+	deleted := true
+	var newest Sibling
+	for _, s := range siblings {
+		if s.Deleted {
+			continue
+		}
+		if deleted || written_before(KVS{Time: newest.Time, HLC: newest.HLC}, KVS{Time: s.Time, HLC: s.HLC}) {
+			value = s.Value
+			newest = s
+			deleted = false
+		}
+	}
+	return value, deleted
+}
+
+// adds value (a delete when next is a tombstone) as the write of next's dot
+// with the client's context, dropping every sibling the new clock covers.
+// Gives back the clock of the new sibling
+func add_sibling(next *KVS, existing []Sibling, value string, ctx vclock.VClock, now time.Time) vclock.VClock {
+	//the dot is above every write this replica took before
+	clock := with_dot(ctx, next.Dot)
+
+	kept := []Sibling{}
+	for _, s := range existing {
+		if !descends(clock, s.Clock) {
+			kept = append(kept, s)
+		}
+	}
+	kept = append(kept, Sibling{Value: value, Deleted: next.Deleted, Clock: clock, Time: now, HLC: next.HLC})
+	sort_siblings(kept)
+	next.Siblings = kept
+	next.Value, next.Deleted = newest_value(kept)
+	return clock
+}
+
+// the union of both versions' siblings, minus the ones another covers
+func merge_siblings(a KVS, b KVS) KVS {
+	all := append(siblings_of(a, true), siblings_of(b, true)...)
+	kept := []Sibling{}
+	for i, s := range all {
+		drop := false
+		for j, other := range all {
+			if i == j || !descends(other.Clock, s.Clock) {
+				continue
+			}
+			//strictly older, or the same write seen twice
+			if !descends(s.Clock, other.Clock) || j < i {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, s)
+		}
+	}
+	sort_siblings(kept)
+
+	out := merge_meta(a, b)
+	out.Siblings = kept
+	out.Value, out.Deleted = newest_value(kept)
+	return out
+}
+
+// the version two replicas end up with: the merged state for two CRDTs
+// of the same type, every sibling in sibling mode, otherwise whichever
+// one keep_local picks
+func combine(local KVS, sent KVS) KVS {
+	if local.CRDT != nil && sent.CRDT != nil && local.CRDT.Type == sent.CRDT.Type {
+		return merge_crdt(local, sent)
+	}
+	if siblings_for(local.Key) {
+		return merge_siblings(local, sent)
+	}
+	if keep_local(local, sent) {
+		return local
+	}
+	return sent
+}
+
+func same_siblings(a []Sibling, b []Sibling) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Value != b[i].Value || a[i].Deleted != b[i].Deleted || !a[i].Time.Equal(b[i].Time) || a[i].HLC != b[i].HLC ||
+			a[i].Clock.ReturnVCString() != b[i].Clock.ReturnVCString() {
+			return false
+		}
+	}
+	return true
+}
+
+// the clocks of every sibling together, writing with it replaces them all
+func context_of(item KVS) vclock.VClock {
+	ctx := vclock.New()
+	for _, s := range item.Siblings {
+		ctx.Merge(s.Clock)
+	}
+	return ctx
+}
+
+// answers a read in sibling mode with every live value
+func sibling_answer(item KVS, ctx CausalContext) dataResult {
+	values := []string{}
+	for _, s := range item.Siblings {
+		if !s.Deleted {
+			values = append(values, s.Value)
+		}
+	}
+	if len(values) == 0 {
+		//written before sibling mode was on
+		values = append(values, item.Value)
+	}
+	return answer_with(200, struct {
+		Value    string        `json:"val"`
+		Siblings []string      `json:"siblings"`
+		Version  CausalContext `json:"causal-metadata"`
+		Context  vclock.VClock `json:"context"`
+	}{item.Value, values, ctx, context_of(item)})
+}
+
+// answers a write in sibling mode, the context only covers the new value
+func sibling_written(item KVS, written vclock.VClock, ctx CausalContext) dataResult {
+	return answer_with(200, struct {
+		Version CausalContext `json:"causal-metadata"`
+		Context vclock.VClock `json:"context"`
+	}{ctx, written})
+}
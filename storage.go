@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The storage engine keeps the KVS (and the view) on disk so a node that
+// restarts comes back with its keys, clocks and tombstones, and with the
+// tombstones it already collected so they can't come back either.
+// Every change is appended to a write-ahead log, and every so often
+// the log is cut and the state it got to is written out as a snapshot,
+// after which the part of the log before the cut can go.
+type Engine interface {
+	// replays the snapshot and the log, returns what was saved
+	Load() (Shards, []KVS, map[string]purgedKey, error)
+	// records a new or updated key (tombstones included)
+	Put(k KVS) error
+	// drops a key from this node, ex. when it moved to another shard
+	Remove(key string) error
+	// records that the tombstone of key was collected
+	Purge(key string, p purgedKey) error
+	// forgets a collected tombstone
+	Unpurge(key string) error
+	// records the current view
+	SetView(v Shards) error
+	// throws away everything, used when the node leaves the view
+	Reset() error
+	// sets the log so far aside and starts a new one, the state at the
+	// cut is what the next Snapshot writes
+	Cut() error
+	// writes the state as of the last Cut and drops the log before it
+	Snapshot(view Shards, keys []KVS, purged map[string]purgedKey) error
+	// makes everything recorded so far durable, whatever the sync policy
+	Sync() error
+	Close() error
+}
+
+// how often the log gets fsynced
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
+)
+
+// one line in the write-ahead log
+type walRecord struct {
+	Op     string     `json:"op"`
+	KVS    *KVS       `json:"kvs,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	View   *Shards    `json:"view,omitempty"`
+	Purged *purgedKey `json:"purged,omitempty"`
+}
+
+// what gets written in a snapshot
+type snapshotFile struct {
+	View   Shards               `json:"view"`
+	Keys   []KVS                `json:"keys"`
+	Purged map[string]purgedKey `json:"purged,omitempty"`
+}
+
+var engine Engine
+
+// picks the engine based on the environment
+//
+//	STORAGE            "wal" (default) or "memory"
+//	DATA_DIR           where the log and snapshots live (default "data")
+//	FSYNC              "always", "interval" (default) or "never"
+//	FSYNC_INTERVAL     milliseconds between fsyncs for "interval" (default 1000)
+func open_engine() (Engine, error) {
+	if os.Getenv("STORAGE") == "memory" {
+		return memEngine{}, nil
+	}
+	dir := data_dir()
+	policy := os.Getenv("FSYNC")
+	if policy == "" {
+		policy = SyncInterval
+	}
+	if policy != SyncAlways && policy != SyncInterval && policy != SyncNever {
+		return nil, fmt.Errorf("unknown FSYNC policy %q", policy)
+	}
+	return open_wal(dir, policy, env_duration("FSYNC_INTERVAL", time.Millisecond, time.Second))
+}
+
+// where the node keeps its files
+func data_dir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "data"
+}
+
+// reads a number from the environment in the given unit, or gives back the default
+func env_duration(name string, unit time.Duration, def time.Duration) time.Duration {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return time.Duration(n) * unit
+}
+
+// reads a number from the environment, or gives back the default
+func env_int(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// keeps nothing, this is how the store worked before
+type memEngine struct{}
+
+func (memEngine) Load() (Shards, []KVS, map[string]purgedKey, error) {
+	return Shards{}, nil, nil, nil
+}
+func (memEngine) Put(k KVS) error                                    { return nil }
+func (memEngine) Remove(key string) error                            { return nil }
+func (memEngine) Purge(key string, p purgedKey) error                { return nil }
+func (memEngine) Unpurge(key string) error                           { return nil }
+func (memEngine) SetView(v Shards) error                             { return nil }
+func (memEngine) Reset() error                                       { return nil }
+func (memEngine) Cut() error                                         { return nil }
+func (memEngine) Snapshot(Shards, []KVS, map[string]purgedKey) error { return nil }
+func (memEngine) Sync() error                                        { return nil }
+func (memEngine) Close() error                                       { return nil }
+
+// append-only log plus snapshots in a directory
+type walEngine struct {
+	mu     sync.Mutex
+	dir    string
+	policy string
+	log    *os.File
+	dirty  bool
+	stop   chan struct{}
+}
+
+func open_wal(dir string, policy string, interval time.Duration) (*walEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &walEngine{dir: dir, policy: policy, stop: make(chan struct{})}
+	if policy == SyncInterval {
+		go e.sync_loop(interval)
+	}
+	return e, nil
+}
+
+func (e *walEngine) log_path() string      { return filepath.Join(e.dir, "wal.log") }
+func (e *walEngine) old_log_path() string  { return filepath.Join(e.dir, "wal.old.log") }
+func (e *walEngine) snapshot_path() string { return filepath.Join(e.dir, "snapshot.json") }
+
+// decodes log records from f until the end or a torn record,
+// gives back the offset after the last good one
+func replay_log(f *os.File, apply func(walRecord)) int64 {
+	dec := json.NewDecoder(f)
+	var good int64
+	for {
+		var rec walRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//the last record was only half written before the crash, drop it
+			fmt.Printf("wal: dropping torn record in %s at offset %d: %v\n", filepath.Base(f.Name()), good, err)
+			break
+		}
+		good = dec.InputOffset()
+		apply(rec)
+	}
+	return good
+}
+
+// applies the snapshot, then the log cut before it was written (if the
+// node went down in between), then every record of the current log.
+// The cut log is already in a snapshot that made it to disk, replaying
+// it again leaves the same state
+func (e *walEngine) Load() (Shards, []KVS, map[string]purgedKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var snap snapshotFile
+	data, err := os.ReadFile(e.snapshot_path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Shards{}, nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return Shards{}, nil, nil, fmt.Errorf("bad snapshot: %w", err)
+		}
+	}
+
+	state := make(map[string]KVS)
+	order := []string{}
+	for _, k := range snap.Keys {
+		if _, ok := state[k.Key]; !ok {
+			order = append(order, k.Key)
+		}
+		state[k.Key] = k
+	}
+	view := snap.View
+	purged := snap.Purged
+	if purged == nil {
+		purged = make(map[string]purgedKey)
+	}
+
+	apply := func(rec walRecord) {
+		switch rec.Op {
+		case "put":
+			if rec.KVS == nil {
+				return
+			}
+			if _, ok := state[rec.KVS.Key]; !ok {
+				order = append(order, rec.KVS.Key)
+			}
+			state[rec.KVS.Key] = *rec.KVS
+		case "remove":
+			delete(state, rec.Key)
+		case "purge":
+			if rec.Purged != nil {
+				purged[rec.Key] = *rec.Purged
+			}
+		case "unpurge":
+			delete(purged, rec.Key)
+		case "view":
+			if rec.View != nil {
+				view = *rec.View
+			}
+		case "reset":
+			//collected tombstones outlive the keys, like in memory
+			state = make(map[string]KVS)
+			order = order[:0]
+			view = Shards{}
+		}
+	}
+
+	old, err := os.Open(e.old_log_path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Shards{}, nil, nil, err
+	}
+	if err == nil {
+		replay_log(old, apply)
+		old.Close()
+	}
+
+	f, err := os.OpenFile(e.log_path(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return Shards{}, nil, nil, err
+	}
+	good := replay_log(f, apply)
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return Shards{}, nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return Shards{}, nil, nil, err
+	}
+	e.log = f
+
+	restored := []KVS{}
+	for _, key := range order {
+		if k, ok := state[key]; ok {
+			restored = append(restored, k)
+			delete(state, key)
+		}
+	}
+	return view, restored, purged, nil
+}
+
+// writes one record to the log, syncing it if the policy says so
+func (e *walEngine) append(rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.log == nil {
+		f, err := os.OpenFile(e.log_path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		e.log = f
+	}
+	if _, err := e.log.Write(line); err != nil {
+		return err
+	}
+	if e.policy == SyncAlways {
+		return e.log.Sync()
+	}
+	e.dirty = true
+	return nil
+}
+
+func (e *walEngine) Put(k KVS) error {
+	return e.append(walRecord{Op: "put", KVS: &k})
+}
+
+func (e *walEngine) Remove(key string) error {
+	return e.append(walRecord{Op: "remove", Key: key})
+}
+
+func (e *walEngine) Purge(key string, p purgedKey) error {
+	return e.append(walRecord{Op: "purge", Key: key, Purged: &p})
+}
+
+func (e *walEngine) Unpurge(key string) error {
+	return e.append(walRecord{Op: "unpurge", Key: key})
+}
+
+func (e *walEngine) SetView(v Shards) error {
+	return e.append(walRecord{Op: "view", View: &v})
+}
+
+func (e *walEngine) Reset() error {
+	return e.append(walRecord{Op: "reset"})
+}
+
+// moves the log to wal.old.log and opens an empty one. A Snapshot that
+// failed leaves the old log behind, then this one goes on the end of it
+func (e *walEngine) Cut() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.log == nil {
+		return nil
+	}
+	if err := e.log.Sync(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(e.old_log_path()); err == nil {
+		if err := e.append_old(); err != nil {
+			return err
+		}
+	} else if err := os.Rename(e.log_path(), e.old_log_path()); err != nil {
+		return err
+	}
+	e.log.Close()
+	f, err := os.OpenFile(e.log_path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		e.log = nil
+		return err
+	}
+	e.log = f
+	e.dirty = false
+	sync_dir(e.dir)
+	return nil
+}
+
+// copies the current log onto the end of the old one
+func (e *walEngine) append_old() error {
+	old, err := os.OpenFile(e.old_log_path(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	cur, err := os.Open(e.log_path())
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	if _, err := io.Copy(old, cur); err != nil {
+		return err
+	}
+	return old.Sync()
+}
+
+// writing and syncing the snapshot happens without the log locked,
+// writes go on to the log that was started at the cut meanwhile
+func (e *walEngine) Snapshot(view Shards, keys []KVS, purged map[string]purgedKey) error {
+	data, err := json.Marshal(snapshotFile{View: view, Keys: keys, Purged: purged})
+	if err != nil {
+		return err
+	}
+	tmp := e.snapshot_path() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.snapshot_path()); err != nil {
+		return err
+	}
+	sync_dir(e.dir)
+
+	//everything in the old log is in the snapshot now
+	if err := os.Remove(e.old_log_path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	sync_dir(e.dir)
+	return nil
+}
+
+// makes renames and removes in dir durable
+func sync_dir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// fsyncs the log in the background for the "interval" policy
+func (e *walEngine) sync_loop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.mu.Lock()
+			if e.dirty && e.log != nil {
+				e.log.Sync()
+				e.dirty = false
+			}
+			e.mu.Unlock()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *walEngine) Sync() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.dirty || e.log == nil {
+		return nil
+	}
+	if err := e.log.Sync(); err != nil {
+		return err
+	}
+	e.dirty = false
+	return nil
+}
+
+func (e *walEngine) Close() error {
+	close(e.stop)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.log == nil {
+		return nil
+	}
+	e.log.Sync()
+	err := e.log.Close()
+	e.log = nil
+	return err
+}
+
+// takes a snapshot every SNAPSHOT_INTERVAL seconds (default 60)
+func start_snapshots() {
+	interval := env_duration("SNAPSHOT_INTERVAL", time.Second, time.Minute)
+	go func() {
+		for {
+			time.Sleep(interval)
+			//a view change that made it into the log before the cut is
+			//in current by the time this runs, one after it is in the new log
+			err := store.Checkpoint(func() Shards {
+				viewMu.RLock()
+				defer viewMu.RUnlock()
+				return current
+			}, tombstones.saved)
+			if err != nil {
+				fmt.Printf("snapshot failed: %v\n", err)
+			}
+		}
+	}()
+}
+
+// loads whatever was saved before the node went down
+func restore_state() {
+	view, saved, purged, err := engine.Load()
+	if err != nil {
+		fmt.Printf("could not load storage: %v\n", err)
+		os.Exit(1)
+	}
+	store = new_store(engine, saved)
+	tombstones.restore(purged)
+	if len(view.Nodes) == 0 || view.Shard == 0 {
+		return
+	}
+	viewMu.Lock()
+	defer viewMu.Unlock()
+	current = view
+	set_shardView()
+	for _, node := range current.Nodes {
+		if node == os.Getenv("ADDRESS") {
+			inView = true
+		}
+	}
+}
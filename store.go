@@ -0,0 +1,275 @@
+package main
+
+import (
+	"sync"
+)
+
+// Store holds the key-value pairs this node is responsible for.
+// All of the handlers and the gossip goroutines go through it,
+// so every implementation has to be safe to use concurrently.
+type Store interface {
+	// returns the current version of the key
+	Get(key string) (KVS, bool)
+	// calls fn with the current version of the key while it is locked.
+	// fn returns the new version and whether it should be written,
+	// Update returns whatever the key holds afterwards
+	Update(key string, fn func(old KVS, found bool) (KVS, bool)) (KVS, error)
+	// drops the key from this node completely
+	Remove(key string) error
+	// drops the key if fn, called while it is locked, says so
+	RemoveIf(key string, fn func(KVS) bool) error
+	// calls fn on every key until it returns false
+	Range(fn func(KVS) bool)
+	// calls fn on every key from from on, in order, until it returns false
+	Ascend(from string, fn func(KVS) bool)
+	// copies out every key
+	All() []KVS
+	Len() int
+	// drops every key
+	Clear() error
+	// writes a snapshot of the store with the engine, view and purged
+	// give the view and the collected tombstones to save with it and are
+	// called once the log has been cut
+	Checkpoint(view func() Shards, purged func() map[string]purgedKey) error
+	// gives back a channel that gets closed the next time any key changes
+	Changed() <-chan struct{}
+	// calls fn with the new version after every write, while the key is
+	// still locked so the changes to a key come in order. fn can't block
+	OnChange(fn func(KVS))
+	// the merkle tree over every key, kept up to date on each change
+	Merkle() *MerkleTree
+}
+
+// how many stripes the keys are spread over, each with its own lock
+const stripeCount = 64
+
+type stripe struct {
+	mu   sync.RWMutex
+	keys map[string]KVS
+}
+
+// a hash map split into stripes so writers to different keys
+// don't wait on each other. Every change is written to the storage
+// engine while the key is still locked, and only shows up in memory
+// once it's in the log.
+type stripedStore struct {
+	stripes [stripeCount]stripe
+	engine  Engine
+	tree    *MerkleTree
+	index   *keyIndex
+	//writers hold this for reading, checkpoints hold it for writing
+	//while they copy the keys and cut the log, so the copy has exactly
+	//the changes from before the cut
+	barrier sync.RWMutex
+	//one checkpoint at a time
+	checkpointMu sync.Mutex
+
+	notifyMu sync.Mutex
+	changed  chan struct{}
+	hooks    []func(KVS)
+}
+
+var store Store
+
+func new_store(e Engine, saved []KVS) *stripedStore {
+	s := &stripedStore{engine: e, tree: new_merkle(), index: new_index()}
+	for i := range s.stripes {
+		s.stripes[i].keys = make(map[string]KVS)
+	}
+	for _, k := range saved {
+		old, found := s.stripe_for(k.Key).keys[k.Key]
+		s.stripe_for(k.Key).keys[k.Key] = k
+		s.tree.update(k.Key, old, found, k, true)
+		s.index.insert(k.Key)
+	}
+	return s
+}
+
+func (s *stripedStore) stripe_for(key string) *stripe {
+	return &s.stripes[hash(key)%stripeCount]
+}
+
+func (s *stripedStore) Get(key string) (KVS, bool) {
+	st := s.stripe_for(key)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	k, ok := st.keys[key]
+	return k, ok
+}
+
+func (s *stripedStore) Update(key string, fn func(old KVS, found bool) (KVS, bool)) (KVS, error) {
+	s.barrier.RLock()
+	defer s.barrier.RUnlock()
+	st := s.stripe_for(key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	old, found := st.keys[key]
+	next, write := fn(old, found)
+	if !write {
+		return old, nil
+	}
+	next.Key = key
+	//a write that didn't make it to the log never happened
+	if err := s.engine.Put(next); err != nil {
+		return old, err
+	}
+	st.keys[key] = next
+	s.tree.update(key, old, found, next, true)
+	if !found {
+		s.index.insert(key)
+	}
+	s.notify()
+	s.notifyMu.Lock()
+	hooks := s.hooks
+	s.notifyMu.Unlock()
+	for _, fn := range hooks {
+		fn(next)
+	}
+	return next, nil
+}
+
+func (s *stripedStore) Remove(key string) error {
+	return s.RemoveIf(key, func(KVS) bool { return true })
+}
+
+func (s *stripedStore) RemoveIf(key string, fn func(KVS) bool) error {
+	s.barrier.RLock()
+	defer s.barrier.RUnlock()
+	st := s.stripe_for(key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	old, ok := st.keys[key]
+	if !ok || !fn(old) {
+		return nil
+	}
+	if err := s.engine.Remove(key); err != nil {
+		return err
+	}
+	delete(st.keys, key)
+	s.tree.update(key, old, true, KVS{}, false)
+	s.index.remove(key)
+	s.notify()
+	return nil
+}
+
+func (s *stripedStore) Range(fn func(KVS) bool) {
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		st.mu.RLock()
+		items := make([]KVS, 0, len(st.keys))
+		for _, k := range st.keys {
+			items = append(items, k)
+		}
+		st.mu.RUnlock()
+		//fn runs without the lock so it can call back into the store
+		for _, k := range items {
+			if !fn(k) {
+				return
+			}
+		}
+	}
+}
+
+// how many keys Ascend takes out of the index at a time
+const ascendBatch = 256
+
+func (s *stripedStore) Ascend(from string, fn func(KVS) bool) {
+	for {
+		keys := s.index.from(from, ascendBatch)
+		//fn runs without the index locked, a key removed since is skipped
+		for _, key := range keys {
+			if k, ok := s.Get(key); ok && !fn(k) {
+				return
+			}
+		}
+		if len(keys) < ascendBatch {
+			return
+		}
+		//the smallest key after the last one
+		from = keys[len(keys)-1] + "\x00"
+	}
+}
+
+func (s *stripedStore) All() []KVS {
+	all := make([]KVS, 0, s.Len())
+	s.Range(func(k KVS) bool {
+		all = append(all, k)
+		return true
+	})
+	return all
+}
+
+func (s *stripedStore) Len() int {
+	n := 0
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		st.mu.RLock()
+		n += len(st.keys)
+		st.mu.RUnlock()
+	}
+	return n
+}
+
+func (s *stripedStore) Clear() error {
+	s.barrier.Lock()
+	defer s.barrier.Unlock()
+	if err := s.engine.Reset(); err != nil {
+		return err
+	}
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		st.mu.Lock()
+		st.keys = make(map[string]KVS)
+		st.mu.Unlock()
+	}
+	s.tree.clear()
+	s.index.clear()
+	s.notify()
+	return nil
+}
+
+// only the copy and the cut happen with writers held off, the
+// snapshot gets written out while they go on
+func (s *stripedStore) Checkpoint(view func() Shards, purged func() map[string]purgedKey) error {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+	s.barrier.Lock()
+	keys := s.All()
+	err := s.engine.Cut()
+	s.barrier.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.engine.Snapshot(view(), keys, purged())
+}
+
+func (s *stripedStore) Changed() <-chan struct{} {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+func (s *stripedStore) OnChange(fn func(KVS)) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.hooks = append(s.hooks, fn)
+}
+
+// wakes up everyone waiting on Changed
+func (s *stripedStore) notify() {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+func (s *stripedStore) Merkle() *MerkleTree {
+	return s.tree
+}
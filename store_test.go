@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// bumps the version of key, the value is the version written out
+func bump(s Store, key string) error {
+	_, err := s.Update(key, func(old KVS, found bool) (KVS, bool) {
+		old.Version++
+		old.Value = fmt.Sprint(old.Version)
+		return old, true
+	})
+	return err
+}
+
+// the tree the store keeps has to match one built from its keys
+func check_tree(t *testing.T, s *stripedStore) {
+	t.Helper()
+	fresh := new_merkle()
+	for _, k := range s.All() {
+		fresh.update(k.Key, KVS{}, false, k, true)
+	}
+	if !reflect.DeepEqual(s.Merkle().levels(), fresh.levels()) {
+		t.Fatal("merkle tree doesn't match the keys in the store")
+	}
+	//and so does the index
+	want := []string{}
+	for _, k := range s.All() {
+		want = append(want, k.Key)
+	}
+	sort.Strings(want)
+	got := []string{}
+	s.Ascend("", func(k KVS) bool {
+		got = append(got, k.Key)
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("index has %v, store has %v", got, want)
+	}
+}
+
+// writers, readers, removers and checkpoints all at once, run with -race
+func run_concurrently(t *testing.T, s *stripedStore) {
+	const writers = 8
+	const rounds = 256
+	const keys = 16
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := bump(s, fmt.Sprintf("k%d", i%keys)); err != nil {
+					t.Error(err)
+					return
+				}
+				//these come and go while everything else runs
+				if err := bump(s, fmt.Sprintf("tmp%d", i%keys)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	var background sync.WaitGroup
+	background.Add(3)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 0; i < keys; i++ {
+				if k, ok := s.Get(fmt.Sprintf("k%d", i)); ok && k.Value != fmt.Sprint(k.Version) {
+					t.Errorf("read a half written key: %+v", k)
+				}
+			}
+			s.Range(func(k KVS) bool {
+				if k.Value != fmt.Sprint(k.Version) {
+					t.Errorf("ranged over a half written key: %+v", k)
+				}
+				return true
+			})
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 0; i < keys; i++ {
+				err := s.RemoveIf(fmt.Sprintf("tmp%d", i), func(k KVS) bool { return k.Version%2 == 0 })
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := s.Checkpoint(func() Shards { return Shards{Shard: 1, Nodes: []string{"a"}} }, tombstones.saved); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	//every bump of the keys nobody removes made it
+	for i := 0; i < keys; i++ {
+		k, ok := s.Get(fmt.Sprintf("k%d", i))
+		if want := uint64(writers * rounds / keys); !ok || k.Version != want {
+			t.Errorf("k%d: version %d, want %d", i, k.Version, want)
+		}
+	}
+	check_tree(t, s)
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	run_concurrently(t, new_store(memEngine{}, nil))
+}
+
+func TestStoreConcurrentWAL(t *testing.T) {
+	dir := t.TempDir()
+	e, err := open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := e.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s := new_store(e, nil)
+	run_concurrently(t, s)
+	before := s.All()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the snapshots and the log together give back the same keys
+	e, err = open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	view, after, _, err := e.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.Shard != 1 {
+		t.Errorf("view not restored: %+v", view)
+	}
+	by_key := func(keys []KVS) {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	}
+	by_key(before)
+	by_key(after)
+	if len(before) != len(after) {
+		t.Fatalf("restored %d keys, had %d", len(after), len(before))
+	}
+	for i := range before {
+		if before[i].Key != after[i].Key || before[i].Version != after[i].Version {
+			t.Errorf("restored %s@%d, had %s@%d", after[i].Key, after[i].Version, before[i].Key, before[i].Version)
+		}
+	}
+}
+
+// a snapshot that fails to be written leaves the cut log to replay
+func TestStoreCheckpointAfterCut(t *testing.T) {
+	dir := t.TempDir()
+	e, err := open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := e.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s := new_store(e, nil)
+	bump(s, "a")
+	//the node goes down between two cuts and the snapshot
+	if err := e.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	bump(s, "b")
+	if err := e.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	bump(s, "a")
+	e.Close()
+
+	e, err = open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	_, keys, _, err := e.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]uint64{}
+	for _, k := range keys {
+		got[k.Key] = k.Version
+	}
+	if want := map[string]uint64{"a": 2, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
+
+// an engine whose log can't be written to
+type brokenEngine struct{ memEngine }
+
+var errBroken = errors.New("disk gone")
+
+func (brokenEngine) Put(KVS) error           { return errBroken }
+func (brokenEngine) Remove(key string) error { return errBroken }
+
+func TestStoreFailedWriteNotApplied(t *testing.T) {
+	s := new_store(brokenEngine{}, []KVS{{Key: "kept", Value: "1", Version: 1}})
+	changed := s.Changed()
+	hooked := false
+	s.OnChange(func(KVS) { hooked = true })
+
+	if err := bump(s, "new"); !errors.Is(err, errBroken) {
+		t.Fatalf("got %v, want the engine's error", err)
+	}
+	if _, ok := s.Get("new"); ok {
+		t.Error("a write that never made it to the log is in memory")
+	}
+	if err := bump(s, "kept"); !errors.Is(err, errBroken) {
+		t.Fatalf("got %v, want the engine's error", err)
+	}
+	if k, _ := s.Get("kept"); k.Version != 1 {
+		t.Errorf("kept went to version %d without being logged", k.Version)
+	}
+	if err := s.RemoveIf("kept", func(KVS) bool { return true }); !errors.Is(err, errBroken) {
+		t.Fatalf("got %v, want the engine's error", err)
+	}
+	if _, ok := s.Get("kept"); !ok {
+		t.Error("a remove that never made it to the log dropped the key")
+	}
+	select {
+	case <-changed:
+		t.Error("watchers were woken up for writes that failed")
+	default:
+	}
+	if hooked {
+		t.Error("hooks ran for writes that failed")
+	}
+	check_tree(t, s)
+}
+
+func TestStoreAscend(t *testing.T) {
+	s := new_store(memEngine{}, []KVS{{Key: "m"}, {Key: "b"}})
+	//more than one batch of keys
+	for i := 0; i < 1000; i++ {
+		bump(s, fmt.Sprintf("k%04d", i))
+	}
+	bump(s, "a")
+	bump(s, "z")
+	s.Remove("k0500")
+	check_tree(t, s)
+
+	tests := []struct {
+		from  string
+		limit int
+		want  []string
+	}{
+		{"", 3, []string{"a", "b", "k0000"}},
+		{"b\x00", 2, []string{"k0000", "k0001"}},
+		{"k0499", 3, []string{"k0499", "k0501", "k0502"}},
+		{"k0998", 10, []string{"k0998", "k0999", "m", "z"}},
+		{"zz", 10, []string{}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		s.Ascend(test.from, func(k KVS) bool {
+			got = append(got, k.Key)
+			return len(got) < test.limit
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("from %q: got %v, want %v", test.from, got, test.want)
+		}
+	}
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	s.Ascend("", func(k KVS) bool {
+		t.Errorf("%s still in the index after a clear", k.Key)
+		return true
+	})
+}
+
+// collected tombstones come back after a restart, from the log and from a snapshot
+func TestPurgedSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	e, err := open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := e.Load(); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 0).UTC()
+	gone := purgedKey{Vector: vclock.VClock{"a": 2}, Version: 2, At: at}
+	e.Purge("snapshotted", gone)
+	e.Purge("forgotten", gone)
+	e.Unpurge("forgotten")
+	if err := e.Cut(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Snapshot(Shards{Shard: 1}, nil, map[string]purgedKey{"snapshotted": gone}); err != nil {
+		t.Fatal(err)
+	}
+	e.Purge("logged", gone)
+	e.Close()
+
+	e, err = open_wal(dir, SyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	_, _, purged, err := e.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]purgedKey{"snapshotted": gone, "logged": gone}; !reflect.DeepEqual(purged, want) {
+		t.Errorf("restored %v, want %v", purged, want)
+	}
+}
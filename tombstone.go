@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Tombstones. A delete keeps the key with Deleted set and the clock of the
+// delete, so it travels through gossip, replication and rebalancing like
+// any other write and an older value showing up later loses to it. They
+// are only dropped once they're causally stable: every
+// TOMBSTONE_GC_INTERVAL seconds a node asks every replica of its shard
+// which of its tombstones they hold a clock at or past, and drops the ones
+// all of them do. A dropped key is remembered, in the storage engine too,
+// so a replica that hasn't dropped it yet can't gossip it (or anything
+// older) back in and a new write to it starts past the delete. It's only
+// forgotten after TOMBSTONE_GRACE seconds once no node of the cluster has
+// keys left to move, since a rebalance or handoff could still be carrying
+// an older copy. Nothing is collected while keys are moving either.
+var tombstoneGCInterval = 10 * time.Second
+var tombstoneGrace = 60 * time.Second
+
+// the most tombstones asked about in one round, the rest wait for the next
+const maxStableBatch = 1000
+
+type purgedKey struct {
+	Vector  vclock.VClock
+	Version uint64
+	At      time.Time
+}
+
+type tombstoneCollector struct {
+	mu     sync.Mutex
+	purged map[string]purgedKey
+}
+
+var tombstones = &tombstoneCollector{purged: make(map[string]purgedKey)}
+
+func load_tombstones() {
+	tombstoneGCInterval = env_duration("TOMBSTONE_GC_INTERVAL", time.Second, tombstoneGCInterval)
+	tombstoneGrace = env_duration("TOMBSTONE_GRACE", time.Second, tombstoneGrace)
+}
+
+// whether a version of key with this clock is one a collected
+// tombstone had already seen
+func (g *tombstoneCollector) covers(key string, vector vclock.VClock) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.purged[key]
+	return ok && descends(p.Vector, vector)
+}
+
+// the clock and version of the collected tombstone of key, nil and 0 if there isn't one
+func (g *tombstoneCollector) clock_of(key string) (vclock.VClock, uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p, ok := g.purged[key]; ok {
+		return p.Vector.Copy(), p.Version
+	}
+	return nil, 0
+}
+
+// picks up the collected tombstones the engine had saved
+func (g *tombstoneCollector) restore(purged map[string]purgedKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, p := range purged {
+		g.purged[key] = p
+	}
+}
+
+// a copy of the collected tombstones for a snapshot
+func (g *tombstoneCollector) saved() map[string]purgedKey {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[string]purgedKey, len(g.purged))
+	for key, p := range g.purged {
+		out[key] = p
+	}
+	return out
+}
+
+// remembers that the tombstone of key was collected, on disk first.
+// Done under mu so a snapshot taken after the record has it too
+func (g *tombstoneCollector) purge(key string, p purgedKey) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := engine.Purge(key, p); err != nil {
+		return err
+	}
+	g.purged[key] = p
+	return nil
+}
+
+// only call once no keys are moving anywhere
+func (g *tombstoneCollector) forget_old(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, p := range g.purged {
+		if now.Sub(p.At) <= tombstoneGrace {
+			continue
+		}
+		if err := engine.Unpurge(key); err != nil {
+			fmt.Printf("storage: %v\n", err)
+			return
+		}
+		delete(g.purged, key)
+	}
+}
+
+// the keys whose tombstone this replica has a clock at or past for
+func stable_keys(sent map[string]vclock.VClock) []string {
+	stable := []string{}
+	for key, vector := range sent {
+		item, found := store.Get(key)
+		if (found && descends(item.Vector, vector)) || (!found && tombstones.covers(key, vector)) {
+			stable = append(stable, key)
+		}
+	}
+	return stable
+}
+
+// asks a replica which of the tombstones it has caught up with
+func ask_stable(address string, sent map[string]vclock.VClock) (map[string]bool, bool) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	var keys []string
+	if !put_json(&client, "http://"+address+"/gossip/stable", sent, &keys) {
+		return nil, false
+	}
+	stable := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stable[key] = true
+	}
+	return stable, true
+}
+
+// asks a node whether it still has keys to move
+func ask_moving(address string) (movingAnswer, bool) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	var answer movingAnswer
+	response, err := client.Get("http://" + address + "/gossip/moving")
+	if err != nil {
+		return answer, false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 || json.NewDecoder(response.Body).Decode(&answer) != nil {
+		return answer, false
+	}
+	return answer, true
+}
+
+// whether no node could still be carrying an old copy of a key: every
+// node of the view has this view or a newer one and nothing left to move,
+// and every node that left it is done handing its keys over. A node that
+// left and can't be reached anymore is taken to be gone
+func moves_settled(v viewState) bool {
+	if rebalance.moving() {
+		return false
+	}
+	for _, address := range v.current.Nodes {
+		if address == os.Getenv("ADDRESS") {
+			continue
+		}
+		answer, ok := ask_moving(address)
+		if !ok || answer.Moving || answer.Epoch < v.current.Epoch {
+			return false
+		}
+	}
+	settled := true
+	for _, address := range rebalance.departed_nodes() {
+		answer, ok := ask_moving(address)
+		if ok && answer.Moving {
+			settled = false
+			continue
+		}
+		rebalance.handed_off(address)
+	}
+	return settled
+}
+
+// one round of collecting this shard's tombstones
+func collect_tombstones() {
+	now := time.Now()
+	v := load_view()
+	if !v.inView || v.current.Shard == 0 || v.selfID < 0 || !moves_settled(v) {
+		return
+	}
+	tombstones.forget_old(now)
+	candidates := make(map[string]vclock.VClock)
+	store.Range(func(item KVS) bool {
+		//a linearizable key's tombstone is part of the log's state
+		if item.Deleted && !linearizable(item.Key) && shard_of(item.Key, v.current) == v.selfID {
+			candidates[item.Key] = item.Vector
+		}
+		return len(candidates) < maxStableBatch
+	})
+	if len(candidates) == 0 {
+		return
+	}
+	//every replica has to answer, one that's down might still have the value
+	for _, address := range shard_peers(v) {
+		stable, ok := ask_stable(address, candidates)
+		if !ok {
+			return
+		}
+		for key := range candidates {
+			if !stable[key] {
+				delete(candidates, key)
+			}
+		}
+	}
+	for key, vector := range candidates {
+		err := store.RemoveIf(key, func(local KVS) bool {
+			//unless it was written to since
+			if !local.Deleted || !descends(vector, local.Vector) {
+				return false
+			}
+			//remembered before it's gone, in case the node goes down in between
+			if err := tombstones.purge(key, purgedKey{vector, local.Version, now}); err != nil {
+				fmt.Printf("storage: %v\n", err)
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			fmt.Printf("storage: %v\n", err)
+		}
+	}
+}
+
+// drops every value but keeps the tombstones, for a node leaving the view
+func drop_values() {
+	store.Range(func(item KVS) bool {
+		err := store.RemoveIf(item.Key, func(local KVS) bool {
+			return !local.Deleted
+		})
+		if err != nil {
+			fmt.Printf("storage: %v\n", err)
+		}
+		return true
+	})
+}
+
+// handler for a replica asking which of its tombstones this one has seen
+func stable_tombstones(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !check_epoch(w, r, load_view()) {
+		return
+	}
+	var sent map[string]vclock.VClock
+	if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(stable_keys(sent))
+}
+
+func start_tombstones() {
+	go func() {
+		for {
+			time.Sleep(tombstoneGCInterval)
+			collect_tombstones()
+		}
+	}()
+}
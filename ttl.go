@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keys that expire. A PUT with "ttl" (in seconds) stores the time the key
+// runs out with it, so the expiry travels with the key through gossip,
+// replication and rebalancing like the rest of it. Reads treat a key past
+// its expiry as gone right away. Taking the space back is the sweeper's
+// job: every TTL_SWEEP_INTERVAL milliseconds the first live replica of
+// each shard turns the keys that ran out into tombstones, the same way a
+// DELETE would, and replicates them at the write consistency level like
+// any other write, gossip gets them to the rest of the shard.
+var ttlSweepInterval = time.Second
+
+// how many expired keys are swept at once
+const sweepParallel = 16
+
+func load_ttl() {
+	ttlSweepInterval = env_duration("TTL_SWEEP_INTERVAL", time.Millisecond, ttlSweepInterval)
+}
+
+// when a key written at now with ttl runs out, nil if it doesn't
+func expiry(ttl int, now time.Time) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	at := now.Add(time.Duration(ttl) * time.Second)
+	return &at
+}
+
+func expired(item KVS, now time.Time) bool {
+	return item.Expires != nil && !now.Before(*item.Expires)
+}
+
+func same_expiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// if the key holds a value a client can read at now
+func present(item KVS, found bool, now time.Time) bool {
+	return found && !item.Deleted && !expired(item, now)
+}
+
+// the tombstone an expired key leaves behind, the whole key ran
+// out so none of its siblings are kept
+func expire_item(item KVS, dot Dot, now time.Time) KVS {
+	item = delete_item(item, dot, now)
+	item.Siblings = nil
+	return item
+}
+
+// tombstones every expired key of this shard, only on its first live replica
+func sweep_expired() {
+	v := load_view()
+	if !v.inView || v.current.Shard == 0 || v.selfID < 0 {
+		return
+	}
+	nodes := live_first(v.shards[v.selfID].Node)
+	if len(nodes) == 0 || nodes[0] != os.Getenv("ADDRESS") {
+		return
+	}
+	now := time.Now()
+	keys := []string{}
+	store.Range(func(item KVS) bool {
+		if !item.Deleted && expired(item, now) && shard_of(item.Key, v.current) == v.selfID {
+			keys = append(keys, item.Key)
+		}
+		return true
+	})
+
+	peers := shard_peers(v)
+	need := required(writeConsistency, len(peers)+1)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, sweepParallel)
+	for _, key := range keys {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			sweep_key(key, now, peers, need)
+			<-slots
+		}(key)
+	}
+	wg.Wait()
+}
+
+// tombstones one key if it's still expired and gets the tombstone onto
+// need replicas of the shard
+func sweep_key(key string, now time.Time, peers []string, need int) {
+	dot := dots.next()
+	defer dots.done(dot)
+	//linearizable keys only change through the log
+	if linearizable(key) {
+		err := raft_submit(raftCommand{Op: "expire", Key: key, Time: now, Dot: dot, HLC: clock.at(now)})
+		if err != nil {
+			fmt.Printf("ttl: %v\n", err)
+		}
+		return
+	}
+	swept := false
+	tombstone, err := store.Update(key, func(item KVS, found bool) (KVS, bool) {
+		//written again since
+		if !found || item.Deleted || !expired(item, now) {
+			return item, false
+		}
+		swept = true
+		return expire_item(item, dot, now), true
+	})
+	if err != nil {
+		fmt.Printf("storage: %v\n", err)
+		return
+	}
+	if swept {
+		replicate(tombstone, peers, need)
+	}
+}
+
+func start_ttl() {
+	go func() {
+		for {
+			time.Sleep(ttlSweepInterval)
+			sweep_expired()
+		}
+	}()
+}
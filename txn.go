@@ -0,0 +1,875 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Multi-key transactions with two-phase commit. The node that gets
+// POST /kvs/txn coordinates: it sends every shard the transaction touches
+// its part, and the shard's lock holder (its first node in the view, so
+// every coordinator picks the same one whatever its failure detector
+// thinks) locks the keys, tells the other replicas of the shard which
+// keys it locked, checks the conditions and answers the reads. Those
+// replicas send writes to a locked key to the holder, which refuses them
+// until the transaction is over. If every shard voted yes
+// the coordinator records the commit and tells them to apply their
+// writes, otherwise it tells them to abort. Both sides keep a journal in
+// DATA_DIR/txn, so after a crash the coordinator finishes what it decided
+// (a transaction it never decided is aborted) and a participant that
+// prepared asks the coordinator what happened before letting go of the keys.
+const (
+	TxnPreparing = "preparing"
+	TxnCommitted = "committed"
+	TxnAborted   = "aborted"
+	//the coordinator has no record of it, so it never committed
+	TxnUnknown = "unknown"
+)
+
+// one write in a transaction
+type TxnWrite struct {
+	Key    string `json:"key"`
+	Value  string `json:"val"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// a condition on one key, same ones a conditional write takes
+type TxnCondition struct {
+	Key string `json:"key"`
+	Condition
+}
+
+// what a client sends to /kvs/txn
+type TxnRequest struct {
+	Reads      []string       `json:"reads"`
+	Conditions []TxnCondition `json:"conditions"`
+	Writes     []TxnWrite     `json:"writes"`
+}
+
+// the part of a transaction one shard handles, also what its
+// participant keeps in its journal while it's prepared
+type txnPart struct {
+	ID          string         `json:"id"`
+	Coordinator string         `json:"coordinator"`
+	Shard       int            `json:"shard_id"`
+	Reads       []string       `json:"reads,omitempty"`
+	Conditions  []TxnCondition `json:"conditions,omitempty"`
+	Writes      []TxnWrite     `json:"writes,omitempty"`
+	Prepared    time.Time      `json:"prepared"`
+	//the dot of each write, picked once when the commit starts so
+	//applying the part again after a crash skips what's already in
+	Dots []Dot `json:"dots,omitempty"`
+}
+
+// the coordinator's journal entry, Participants only holds the ones
+// that haven't acknowledged the decision yet
+type txnRecord struct {
+	ID           string             `json:"id"`
+	State        string             `json:"state"`
+	Participants map[string]txnPart `json:"participants"`
+}
+
+// a participant's answer to a prepare
+type txnVote struct {
+	Vote   bool   `json:"vote"`
+	Reason string `json:"reason,omitempty"`
+	Key    string `json:"key,omitempty"`
+	//nil for a key that doesn't exist
+	Reads map[string]*string `json:"reads,omitempty"`
+}
+
+// a participant's answer to a commit or abort
+type txnAck struct {
+	//the clocks of the keys it wrote, as causal metadata for its shard
+	Vector CausalContext `json:"causal-metadata,omitempty"`
+}
+
+type txnManager struct {
+	mu sync.Mutex
+	//which transaction holds each key locked
+	locks    map[string]string
+	prepared map[string]*txnPart
+	//transactions this node coordinates that still have to be finished
+	records map[string]*txnRecord
+	//what the lock holder of this node's shard said it locked, by
+	//transaction and by key. Writes to those keys go to the holder
+	hints  map[string]*txnPart
+	hinted map[string]string
+	//parts whose writes are being applied right now
+	committing map[string]bool
+}
+
+var txns = &txnManager{
+	locks:    make(map[string]string),
+	prepared: make(map[string]*txnPart),
+	records:  make(map[string]*txnRecord),
+	hints:    make(map[string]*txnPart),
+	hinted:   make(map[string]string),
+
+	committing: make(map[string]bool),
+}
+
+// knobs, set by TXN_RETRY (milliseconds) and TXN_IN_DOUBT (seconds):
+// how often unfinished transactions are retried, and how long a
+// participant waits for the decision before asking the coordinator
+var txnRetry = time.Second
+var txnInDoubt = 5 * time.Second
+
+var errTxnLocked = errors.New("locked by another transaction")
+
+// where the journals live, empty when nothing is kept on disk
+func txn_dir() string {
+	if os.Getenv("STORAGE") == "memory" {
+		return ""
+	}
+	return filepath.Join(data_dir(), "txn")
+}
+
+// writes a journal entry so it survives a crash
+func write_record(name string, v interface{}) error {
+	dir := txn_dir()
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(v)
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func remove_record(name string) {
+	if dir := txn_dir(); dir != "" {
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+func load_txns() {
+	txnRetry = env_duration("TXN_RETRY", time.Millisecond, txnRetry)
+	txnInDoubt = env_duration("TXN_IN_DOUBT", time.Second, txnInDoubt)
+	dir := txn_dir()
+	if dir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(file)
+		switch {
+		case strings.HasPrefix(name, "coord-"):
+			var rec txnRecord
+			if json.Unmarshal(data, &rec) != nil {
+				continue
+			}
+			//went down before deciding, nobody can have committed it
+			if rec.State == TxnPreparing {
+				rec.State = TxnAborted
+				write_record(name, rec)
+			}
+			txns.records[rec.ID] = &rec
+		case strings.HasPrefix(name, "part-"):
+			var part txnPart
+			if json.Unmarshal(data, &part) != nil {
+				continue
+			}
+			//still in doubt, keep the keys locked until we hear the decision
+			txns.prepared[part.ID] = &part
+			for _, key := range part_keys(part) {
+				txns.locks[key] = part.ID
+			}
+		}
+	}
+}
+
+// every key a part touches
+func part_keys(part txnPart) []string {
+	keys := append([]string{}, part.Reads...)
+	for _, c := range part.Conditions {
+		keys = append(keys, c.Key)
+	}
+	for _, w := range part.Writes {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+// whether a transaction holds the key right now
+func (t *txnManager) locked(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.locks[key]
+	return ok
+}
+
+// locks every key of the part or none of them
+func (t *txnManager) lock(part txnPart) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := part_keys(part)
+	for _, key := range keys {
+		if id, ok := t.locks[key]; ok && id != part.ID {
+			return errTxnLocked
+		}
+	}
+	for _, key := range keys {
+		t.locks[key] = part.ID
+	}
+	return nil
+}
+
+func (t *txnManager) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, holder := range t.locks {
+		if holder == id {
+			delete(t.locks, key)
+		}
+	}
+}
+
+// whether the shard's lock holder said a transaction holds the key
+func (t *txnManager) hinted_at(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.hinted[key]
+	return ok
+}
+
+// notes the keys the lock holder locked for a transaction
+func (t *txnManager) hint(part txnPart) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	part.Prepared = time.Now()
+	t.hints[part.ID] = &part
+	for _, key := range part_keys(part) {
+		t.hinted[key] = part.ID
+	}
+}
+
+func (t *txnManager) unhint(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.hints, id)
+	for key, holder := range t.hinted {
+		if holder == id {
+			delete(t.hinted, key)
+		}
+	}
+}
+
+// the node that holds the transaction locks of a shard. It only depends
+// on the view, so coordinators that disagree on who's alive still lock
+// on the same node
+func lock_holder(upstream NodeShards) string {
+	if len(upstream.Node) == 0 {
+		return ""
+	}
+	return upstream.Node[0]
+}
+
+// tells the client a transaction is holding the key
+func txn_locked() dataResult {
+	return answer_with(409, map[string]string{"error": "key is locked by a transaction"})
+}
+
+// keeps a write off a key a transaction holds. The lock holder refuses
+// it, any other replica that was told about the lock sends it to the
+// holder, which knows whether it's still held. Gives back the answer and
+// whether there was one
+func txn_guard(method string, path string, k string, req interface{}, v viewState) (dataResult, bool) {
+	if txns.locked(k) {
+		return txn_locked(), true
+	}
+	if !txns.hinted_at(k) || v.current.Shard == 0 {
+		return dataResult{}, false
+	}
+	upstream := v.shards[shard_of(k, v.current)]
+	holder := lock_holder(upstream)
+	if holder == "" || holder == os.Getenv("ADDRESS") {
+		return dataResult{}, false
+	}
+	return relay(method, path, req, NodeShards{upstream.Shard, []string{holder}}), true
+}
+
+// splits the transaction by the shard each key lives on
+func split_txn(req TxnRequest, v viewState, id string) map[int]*txnPart {
+	parts := make(map[int]*txnPart)
+	part := func(key string) *txnPart {
+		shard := shard_of(key, v.current)
+		if parts[shard] == nil {
+			parts[shard] = &txnPart{ID: id, Coordinator: os.Getenv("ADDRESS"), Shard: shard}
+		}
+		return parts[shard]
+	}
+	for _, key := range req.Reads {
+		p := part(key)
+		p.Reads = append(p.Reads, key)
+	}
+	for _, c := range req.Conditions {
+		p := part(c.Key)
+		p.Conditions = append(p.Conditions, c)
+	}
+	for _, w := range req.Writes {
+		p := part(w.Key)
+		p.Writes = append(p.Writes, w)
+	}
+	return parts
+}
+
+// handler for POST /kvs/txn, this node coordinates the transaction
+func kvs_txn(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	if !v.inView {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TxnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	keys := append([]string{}, req.Reads...)
+	for _, c := range req.Conditions {
+		keys = append(keys, c.Key)
+	}
+	for _, wr := range req.Writes {
+		if len(wr.Value) > 8000000 {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad write for " + wr.Key})
+			return
+		}
+		keys = append(keys, wr.Key)
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "empty transaction"})
+		return
+	}
+	for _, key := range keys {
+		if key == "" || len(key) > 2048 {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+			return
+		}
+		//those only change through their shard's raft log
+		if linearizable(key) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "linearizable keys can't be in a transaction"})
+			return
+		}
+	}
+	if v.current.Shard == 0 {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "divide by 0"})
+		return
+	}
+
+	id := fmt.Sprintf("%x-%x", hash(os.Getenv("ADDRESS")), time.Now().UnixNano())
+	rec := &txnRecord{ID: id, State: TxnPreparing, Participants: make(map[string]txnPart)}
+	for shard, part := range split_txn(req, v, id) {
+		holder := lock_holder(v.shards[shard])
+		if holder == "" {
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(struct {
+				Error    string     `json:"error"`
+				Upstream NodeShards `json:"upstream"`
+			}{"upstream down", v.shards[shard]})
+			return
+		}
+		rec.Participants[holder] = *part
+	}
+	if err := txns.journal(rec); err != nil {
+		storage_error(w, err)
+		return
+	}
+
+	//phase one
+	votes := make(chan txnVote, len(rec.Participants))
+	for address, part := range rec.Participants {
+		go func(address string, part txnPart) {
+			client := http.Client{
+				Timeout: quorumTimeout,
+			}
+			var vote txnVote
+			if !put_json(&client, "http://"+address+"/txn/prepare", part, &vote) {
+				vote = txnVote{Vote: false, Reason: "no answer from " + address}
+			}
+			votes <- vote
+		}(address, part)
+	}
+	reads := make(map[string]*string)
+	var refused *txnVote
+	for range rec.Participants {
+		vote := <-votes
+		if !vote.Vote && refused == nil {
+			refused = &vote
+		}
+		for key, val := range vote.Reads {
+			reads[key] = val
+		}
+	}
+
+	//the decision is final once it's in the journal
+	decided := &txnRecord{ID: id, State: TxnCommitted, Participants: rec.Participants}
+	if refused != nil {
+		decided.State = TxnAborted
+	}
+	if err := txns.journal(decided); err != nil {
+		//not recorded, so it's still undecided and gets aborted
+		decided.State = TxnAborted
+		txns.finish(decided)
+		storage_error(w, err)
+		return
+	}
+	vectors := txns.finish(decided)
+
+	if refused != nil {
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(struct {
+			Error  string `json:"error"`
+			ID     string `json:"id"`
+			Reason string `json:"reason"`
+			Key    string `json:"key,omitempty"`
+		}{"transaction aborted", id, refused.Reason, refused.Key})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(struct {
+		ID      string             `json:"id"`
+		Status  string             `json:"status"`
+		Reads   map[string]*string `json:"reads"`
+		Version CausalContext      `json:"causal-metadata"`
+	}{id, TxnCommitted, reads, vectors})
+}
+
+// saves the coordinator's record, or drops it once everyone acknowledged
+func (t *txnManager) journal(rec *txnRecord) error {
+	name := "coord-" + rec.ID + ".json"
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(rec.Participants) == 0 {
+		delete(t.records, rec.ID)
+		remove_record(name)
+		return nil
+	}
+	t.records[rec.ID] = rec
+	return write_record(name, rec)
+}
+
+// phase two, sends the decision to every participant that hasn't
+// acknowledged it yet. The ones that don't answer stay in the record
+// and the background loop tries them again
+func (t *txnManager) finish(rec *txnRecord) CausalContext {
+	t.mu.Lock()
+	state := rec.State
+	pending := make(map[string]txnPart)
+	for address, part := range rec.Participants {
+		pending[address] = part
+	}
+	t.mu.Unlock()
+
+	op := "commit"
+	if state != TxnCommitted {
+		op = "abort"
+	}
+	type result struct {
+		address string
+		ack     txnAck
+		ok      bool
+	}
+	results := make(chan result, len(pending))
+	for address, part := range pending {
+		go func(address string, part txnPart) {
+			client := http.Client{
+				Timeout: quorumTimeout,
+			}
+			var ack txnAck
+			ok := put_json(&client, "http://"+address+"/txn/"+op, part, &ack)
+			results <- result{address, ack, ok}
+		}(address, part)
+	}
+	vectors := CausalContext{}
+	t.mu.Lock()
+	next := &txnRecord{ID: rec.ID, State: state, Participants: make(map[string]txnPart)}
+	for address, part := range rec.Participants {
+		next.Participants[address] = part
+	}
+	t.mu.Unlock()
+	for range pending {
+		res := <-results
+		if !res.ok {
+			continue
+		}
+		delete(next.Participants, res.address)
+		vectors.merge(res.ack.Vector)
+	}
+	if err := t.journal(next); err != nil {
+		fmt.Printf("txn: %v\n", err)
+	}
+	return vectors
+}
+
+// handler for the coordinator asking this node to prepare its part
+func txn_prepare(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var part txnPart
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil || part.ID == "" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(txns.prepare(part))
+}
+
+// locks the keys, checks the conditions and reads, then promises to
+// commit if asked to
+func (t *txnManager) prepare(part txnPart) txnVote {
+	v := load_view()
+	for _, key := range part_keys(part) {
+		if !v.inView || shard_of(key, v.current) != v.selfID {
+			return txnVote{Vote: false, Reason: "not the owning shard", Key: key}
+		}
+	}
+	if lock_holder(v.shards[v.selfID]) != os.Getenv("ADDRESS") {
+		return txnVote{Vote: false, Reason: "not the lock holder"}
+	}
+	if err := t.lock(part); err != nil {
+		return txnVote{Vote: false, Reason: err.Error()}
+	}
+	//a replica that didn't hear about the lock would take writes to the keys
+	if address, ok := announce_lock(part, shard_peers(v)); !ok {
+		t.release(part.ID)
+		return txnVote{Vote: false, Reason: "no answer from " + address}
+	}
+	for _, c := range part.Conditions {
+		item, found := store.Get(c.Key)
+		if !c.Condition.holds(item, found, time.Now()) {
+			t.release(part.ID)
+			return txnVote{Vote: false, Reason: "precondition failed", Key: c.Key}
+		}
+	}
+	reads := make(map[string]*string)
+	for _, key := range part.Reads {
+		if item, found := store.Get(key); present(item, found, time.Now()) {
+			value := item.Value
+			reads[key] = &value
+		} else {
+			reads[key] = nil
+		}
+	}
+	part.Prepared = time.Now()
+	if err := write_record("part-"+part.ID+".json", part); err != nil {
+		t.release(part.ID)
+		return txnVote{Vote: false, Reason: "storage failure"}
+	}
+	t.mu.Lock()
+	t.prepared[part.ID] = &part
+	t.mu.Unlock()
+	return txnVote{Vote: true, Reads: reads}
+}
+
+// applies the writes of a prepared part and lets go of its keys. False
+// when a write didn't make it into the store, the part stays prepared
+// and the coordinator asks again
+func (t *txnManager) commit(id string) (txnAck, bool) {
+	ack := txnAck{Vector: CausalContext{}}
+	t.mu.Lock()
+	part, ok := t.prepared[id]
+	if !ok {
+		t.mu.Unlock()
+		//already done, the coordinator just didn't hear about it
+		return ack, true
+	}
+	if t.committing[id] {
+		//a retry while the first one is still writing
+		t.mu.Unlock()
+		return ack, false
+	}
+	t.committing[id] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.committing, id)
+		t.mu.Unlock()
+	}()
+
+	if len(part.Dots) != len(part.Writes) {
+		next := *part
+		next.Dots = make([]Dot, len(part.Writes))
+		for i := range next.Dots {
+			next.Dots[i] = dots.next()
+		}
+		if err := write_record("part-"+id+".json", next); err != nil {
+			for _, dot := range next.Dots {
+				dots.done(dot)
+			}
+			fmt.Printf("storage: %v\n", err)
+			return ack, false
+		}
+		t.mu.Lock()
+		t.prepared[id] = &next
+		t.mu.Unlock()
+		part = &next
+	}
+
+	v := load_view()
+	peers := shard_peers(v)
+	now := time.Now()
+	for i, wr := range part.Writes {
+		wr, dot := wr, part.Dots[i]
+		item, err := store.Update(wr.Key, func(item KVS, found bool) (KVS, bool) {
+			//the keys are locked, so only this part can have written the dot
+			if found && item.Vector[dot.Node] >= dot.Counter {
+				return item, false
+			}
+			var next KVS
+			if wr.Delete {
+				if !present(item, found, now) {
+					return item, false
+				}
+				next = delete_item(item, dot, now)
+			} else {
+				next = put_item(item, found, wr.Key, wr.Value, nil, dot, now)
+			}
+			if siblings_for(wr.Key) {
+				//the transaction saw the key locked, it replaces every value
+				add_sibling(&next, siblings_of(item, found), wr.Value, context_of(item), now)
+			}
+			return next, true
+		})
+		if err != nil {
+			//the dots stay taken, the retry writes with the same ones
+			fmt.Printf("storage: %v\n", err)
+			return ack, false
+		}
+		dots.done(dot)
+		//the rest of the shard catches up through gossip if this falls short
+		replicate(item, peers, required(writeConsistency, len(peers)+1))
+		ack.Vector = ack.Vector.with(v.selfID, item.Vector)
+	}
+	t.release(id)
+	return ack, true
+}
+
+func (t *txnManager) release(id string) {
+	remove_record("part-" + id + ".json")
+	t.mu.Lock()
+	delete(t.prepared, id)
+	t.mu.Unlock()
+	t.unlock(id)
+	//a replica that misses this keeps sending the writes here,
+	//and drops the lock once the coordinator says it's over
+	go announce_unlock(id, shard_peers(load_view()))
+}
+
+// tells every other replica of the shard about the locks, all of them
+// have to take it. Gives back the first one that didn't
+func announce_lock(part txnPart, peers []string) (string, bool) {
+	failed := make(chan string, len(peers))
+	for _, address := range peers {
+		go func(address string) {
+			client := http.Client{
+				Timeout: quorumTimeout,
+			}
+			var ack map[string]string
+			if !put_json(&client, "http://"+address+"/txn/lock", part, &ack) {
+				failed <- address
+				return
+			}
+			failed <- ""
+		}(address)
+	}
+	first := ""
+	for range peers {
+		if address := <-failed; address != "" && first == "" {
+			first = address
+		}
+	}
+	return first, first == ""
+}
+
+func announce_unlock(id string, peers []string) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	for _, address := range peers {
+		var ack map[string]string
+		put_json(&client, "http://"+address+"/txn/unlock", txnPart{ID: id}, &ack)
+	}
+}
+
+// handler for the lock holder saying which keys it locked or let go of
+func txn_hint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var part txnPart
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil || part.ID == "" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	if mux.Vars(r)["op"] == "lock" {
+		txns.hint(part)
+	} else {
+		txns.unhint(part.ID)
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(map[string]string{"result": "ok"})
+}
+
+// handler for the coordinator's decision
+func txn_decide(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var part txnPart
+	if err := json.NewDecoder(r.Body).Decode(&part); err != nil || part.ID == "" {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad request"})
+		return
+	}
+	ack := txnAck{}
+	if mux.Vars(r)["op"] == "commit" {
+		var ok bool
+		if ack, ok = txns.commit(part.ID); !ok {
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(map[string]string{"error": "storage failure"})
+			return
+		}
+	} else {
+		txns.release(part.ID)
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(ack)
+}
+
+// handler for a participant asking how a transaction ended
+func txn_status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	state := TxnUnknown
+	txns.mu.Lock()
+	if rec, ok := txns.records[id]; ok {
+		state = rec.State
+	}
+	txns.mu.Unlock()
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "state": state})
+}
+
+// asks the coordinator how a transaction ended, false if it couldn't tell
+func txn_state(part txnPart) (string, bool) {
+	client := http.Client{
+		Timeout: quorumTimeout,
+	}
+	response, err := client.Get("http://" + part.Coordinator + "/txn/status/" + part.ID)
+	if err != nil {
+		return "", false
+	}
+	defer response.Body.Close()
+	var status map[string]string
+	if json.NewDecoder(response.Body).Decode(&status) != nil {
+		return "", false
+	}
+	return status["state"], true
+}
+
+// drops a lock the holder told us about once the transaction is over,
+// in case the holder's word that it let go of it never came
+func (t *txnManager) expire_hint(part txnPart) {
+	if state, ok := txn_state(part); ok && state != TxnPreparing {
+		t.unhint(part.ID)
+	}
+}
+
+// asks the coordinator of a part that has been in doubt too long
+func (t *txnManager) resolve(part txnPart) {
+	state, ok := txn_state(part)
+	if !ok {
+		//can't know, keep the keys locked
+		return
+	}
+	switch state {
+	case TxnCommitted:
+		t.commit(part.ID)
+	case TxnAborted, TxnUnknown:
+		t.release(part.ID)
+	}
+}
+
+// finishes the transactions that were left halfway, on both sides
+func start_txns() {
+	go func() {
+		for {
+			time.Sleep(txnRetry)
+			txns.mu.Lock()
+			records := []*txnRecord{}
+			for _, rec := range txns.records {
+				if rec.State != TxnPreparing {
+					records = append(records, rec)
+				}
+			}
+			doubts := []txnPart{}
+			for _, part := range txns.prepared {
+				if time.Since(part.Prepared) > txnInDoubt {
+					doubts = append(doubts, *part)
+				}
+			}
+			hints := []txnPart{}
+			for _, part := range txns.hints {
+				if time.Since(part.Prepared) > txnInDoubt {
+					hints = append(hints, *part)
+				}
+			}
+			txns.mu.Unlock()
+			for _, rec := range records {
+				txns.finish(rec)
+			}
+			for _, part := range doubts {
+				txns.resolve(part)
+			}
+			for _, part := range hints {
+				txns.expire_hint(part)
+			}
+		}
+	}()
+}
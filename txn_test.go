@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// an engine that can't write some of the keys
+type flakyEngine struct {
+	memEngine
+	broken map[string]bool
+}
+
+func (e flakyEngine) Put(k KVS) error {
+	if e.broken[k.Key] {
+		return errBroken
+	}
+	return nil
+}
+
+func new_txns() *txnManager {
+	return &txnManager{
+		locks:      make(map[string]string),
+		prepared:   make(map[string]*txnPart),
+		records:    make(map[string]*txnRecord),
+		hints:      make(map[string]*txnPart),
+		hinted:     make(map[string]string),
+		committing: make(map[string]bool),
+	}
+}
+
+// swaps in a store for one test
+func use_store(t *testing.T, s Store) {
+	old := store
+	store = s
+	t.Cleanup(func() { store = old })
+}
+
+func sibling(value string, node string, at time.Time) Sibling {
+	return Sibling{Value: value, Clock: vclock.VClock{node: 1}, Time: at}
+}
+
+func TestTxnCommitOverSiblings(t *testing.T) {
+	t.Setenv("STORAGE", "memory")
+	t.Setenv("ADDRESS", "self")
+	siblingMode = true
+	t.Cleanup(func() { siblingMode = false })
+
+	at := time.Now().Add(-time.Minute)
+	both := []Sibling{sibling("a", "x", at), sibling("b", "y", at.Add(time.Second))}
+	clocks := vclock.VClock{"x": 1, "y": 1}
+	old := []KVS{
+		{Key: "k", Value: "b", Siblings: both, Vector: clocks, Version: 2, Time: at},
+		{Key: "d", Value: "b", Siblings: both, Vector: clocks, Version: 2, Time: at},
+	}
+	use_store(t, new_store(memEngine{}, old))
+
+	m := new_txns()
+	m.prepared["t1"] = &txnPart{ID: "t1", Writes: []TxnWrite{{Key: "k", Value: "c"}, {Key: "d", Delete: true}}}
+	if _, ok := m.commit("t1"); !ok {
+		t.Fatal("commit failed")
+	}
+
+	k, _ := store.Get("k")
+	if k.Value != "c" || len(k.Siblings) != 1 {
+		t.Errorf("k is %q with %d siblings, want only c", k.Value, len(k.Siblings))
+	}
+	d, _ := store.Get("d")
+	if !d.Deleted || len(d.Siblings) != 1 {
+		t.Errorf("d deleted %v with %d siblings, want one tombstone", d.Deleted, len(d.Siblings))
+	}
+	//a replica that still has the old siblings ends up with the commit
+	for i, merged := range []KVS{combine(old[0], k), combine(k, old[0])} {
+		if merged.Value != "c" || len(merged.Siblings) != 1 {
+			t.Errorf("merge %d: got %q with %d siblings, want only c", i, merged.Value, len(merged.Siblings))
+		}
+	}
+	if merged := combine(old[1], d); !merged.Deleted {
+		t.Errorf("merging d brought back %q", merged.Value)
+	}
+}
+
+// a write that doesn't make it keeps the part, and the retry only
+// applies what's missing
+func TestTxnCommitRetried(t *testing.T) {
+	t.Setenv("STORAGE", "memory")
+	t.Setenv("ADDRESS", "self")
+	e := flakyEngine{broken: map[string]bool{"b": true}}
+	use_store(t, new_store(e, nil))
+
+	m := new_txns()
+	m.prepared["t1"] = &txnPart{ID: "t1", Writes: []TxnWrite{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}}
+	if _, ok := m.commit("t1"); ok {
+		t.Fatal("commit acked with b not written")
+	}
+	part, ok := m.prepared["t1"]
+	if !ok {
+		t.Fatal("the part was dropped after a failed commit")
+	}
+	if len(part.Dots) != 2 {
+		t.Fatalf("the part has %d dots, want one for each write", len(part.Dots))
+	}
+	a, _ := store.Get("a")
+
+	delete(e.broken, "b")
+	if _, ok := m.commit("t1"); !ok {
+		t.Fatal("retried commit failed")
+	}
+	if again, _ := store.Get("a"); again.Version != a.Version || again.Dot != a.Dot {
+		t.Errorf("a was written again, version %d to %d", a.Version, again.Version)
+	}
+	if b, found := store.Get("b"); !found || b.Value != "2" || b.Dot != part.Dots[1] {
+		t.Errorf("b is %+v, want 2 written with its dot", b)
+	}
+	if _, ok := m.prepared["t1"]; ok {
+		t.Error("the part is still prepared after the commit")
+	}
+
+	//the same part replayed from the journal changes nothing
+	m.prepared["t1"] = part
+	before, _ := store.Get("b")
+	if _, ok := m.commit("t1"); !ok {
+		t.Fatal("replayed commit failed")
+	}
+	if after, _ := store.Get("b"); after.Version != before.Version {
+		t.Errorf("replay wrote b again, version %d to %d", before.Version, after.Version)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.tu-berlin.de/mcc-fred/vclock"
+)
+
+// Watching keys. GET /kvs/watch?key= (or ?prefix=) keeps the connection
+// open and sends every change to the matching keys as a Server-Sent
+// Event. The events come from the store's change hook, so writes from
+// clients, replication, gossip and rebalancing all show up. A watch on a
+// key another shard owns, or on a prefix, relays the events of the other
+// shards' replicas too. Every event carries causal metadata, a client
+// that comes back with the last one it got (?since= or "causal-metadata"
+// in the body) first gets every matching key whose clock that metadata
+// doesn't cover. Writes don't reach the store in the order of their dots,
+// so the metadata is the node's causal knowledge when the change was
+// published, which only covers a replica's writes up to where this node
+// has all of them, and not the clocks of the keys sent.
+type watchEvent struct {
+	//"put" or "delete"
+	Type    string        `json:"type"`
+	Key     string        `json:"key"`
+	Value   string        `json:"val"`
+	Version uint64        `json:"version"`
+	Vector  vclock.VClock `json:"clock"`
+	Time    time.Time     `json:"time"`
+	//what to come back with, covers every change sent before this one
+	//(this one too, unless writes before it were still going on)
+	Context CausalContext `json:"causal-metadata,omitempty"`
+	//what the node had all of when the change was published, every
+	//change it covers was published before this one
+	known vclock.VClock
+}
+
+// how many events a watcher can fall behind before it gets cut off,
+// it can come back with the metadata it got and catch up from there
+const watchBuffer = 256
+
+// comment lines sent this often keep proxies from closing an idle stream
+const watchHeartbeat = 15 * time.Second
+
+type watcher struct {
+	key    string
+	prefix string
+	events chan watchEvent
+}
+
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+var watches = &watchHub{watchers: make(map[*watcher]struct{})}
+
+func (w *watcher) matches(key string) bool {
+	if w.key != "" {
+		return key == w.key
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+func event_of(item KVS) watchEvent {
+	ev := watchEvent{Type: "put", Key: item.Key, Value: item.Value, Version: item.Version, Vector: item.Vector, Time: item.Time}
+	if item.Deleted {
+		ev.Type = "delete"
+	}
+	return ev
+}
+
+// the store's change hook, hands the change to every watcher that wants
+// it. Called with the key locked, so it never waits on a watcher
+func (h *watchHub) publish(item KVS) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ev *watchEvent
+	for w := range h.watchers {
+		if !w.matches(item.Key) {
+			continue
+		}
+		if ev == nil {
+			e := event_of(item)
+			e.known = causal.snapshot()
+			ev = &e
+		}
+		select {
+		case w.events <- *ev:
+		default:
+			//too far behind, closing the channel ends its stream
+			delete(h.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+func (h *watchHub) add(key string, prefix string) *watcher {
+	w := &watcher{key: key, prefix: prefix, events: make(chan watchEvent, watchBuffer)}
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	return w
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+func start_watches() {
+	store.OnChange(watches.publish)
+}
+
+// the keys matching the watch whose clock the client's metadata for
+// their shard doesn't cover, those are the ones it hasn't seen
+func catch_up(v viewState, key string, prefix string, since CausalContext) []watchEvent {
+	events := []watchEvent{}
+	now := time.Now()
+	from := prefix
+	if key != "" {
+		from = key
+	}
+	store.Ascend(from, func(item KVS) bool {
+		if (key != "" && item.Key != key) || !strings.HasPrefix(item.Key, prefix) {
+			return false
+		}
+		//the sweeper's tombstone for it comes through as a delete
+		if !item.Deleted && expired(item, now) {
+			return true
+		}
+		if descends(since[shard_of(item.Key, v.current)], item.Vector) {
+			return true
+		}
+		events = append(events, event_of(item))
+		return true
+	})
+	return events
+}
+
+// sends the events of another shard's watch into out until ctx ends,
+// reconnecting from where it left off when the stream breaks. since is
+// nil when the client didn't come back from anywhere
+func relay_watch(ctx context.Context, upstream NodeShards, query url.Values, since CausalContext, out chan<- watchEvent) {
+	seen := since
+	for {
+		for _, address := range live_first(upstream.Node) {
+			params := url.Values{}
+			for name, values := range query {
+				params[name] = values
+			}
+			params.Set("local", "true")
+			params.Del("since")
+			if seen != nil {
+				after, _ := json.Marshal(seen)
+				params.Set("since", string(after))
+			}
+			r, _ := http.NewRequestWithContext(ctx, "GET", "http://"+address+"/kvs/watch?"+params.Encode(), nil)
+			response, err := http.DefaultClient.Do(r)
+			if err != nil {
+				continue
+			}
+			//whatever happens from here on, coming back catches up
+			if seen == nil {
+				seen = CausalContext{}
+			}
+			scanner := bufio.NewScanner(response.Body)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				var ev watchEvent
+				if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev) != nil || ev.Key == "" {
+					continue
+				}
+				seen = seen.with(upstream.Shard, ev.Context[upstream.Shard])
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+				}
+			}
+			response.Body.Close()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// handler for GET /kvs/watch
+func watch_keys(w http.ResponseWriter, r *http.Request) {
+	v := load_view()
+	if !v.inView || v.current.Shard == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(418)
+		json.NewEncoder(w).Encode(map[string]string{"error": "uninitialized"})
+		return
+	}
+	params := r.URL.Query()
+	key, prefix := params.Get("key"), params.Get("prefix")
+	flusher, ok := w.(http.Flusher)
+	//exactly one of key and prefix, an empty prefix watches everything
+	if (key != "") == params.Has("prefix") || !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "watch takes either key or prefix"})
+		return
+	}
+	//nil unless the client comes back with metadata it got before
+	var since CausalContext
+	if raw := params.Get("since"); raw != "" {
+		if json.Unmarshal([]byte(raw), &since) != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad since"})
+			return
+		}
+	} else {
+		var req struct {
+			Vector CausalContext `json:"causal-metadata"`
+		}
+		if json.NewDecoder(r.Body).Decode(&req) == nil && req.Vector != nil {
+			since = req.Vector
+		}
+	}
+
+	//which shards have keys for this watch
+	remote := []NodeShards{}
+	local := params.Get("local") == "true"
+	if !local {
+		for _, upstream := range v.shards {
+			if upstream.Shard == v.selfID {
+				continue
+			}
+			if key == "" || shard_of(key, v.current) == upstream.Shard {
+				remote = append(remote, upstream)
+			}
+		}
+	}
+
+	//listen before catching up so nothing falls in between
+	mine := watches.add(key, prefix)
+	defer watches.remove(mine)
+	//everything the node has all of now is in the store, so it's in
+	//the catch up or covered by since
+	start := causal.snapshot()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	relayed := make(chan watchEvent, watchBuffer)
+	for _, upstream := range remote {
+		go relay_watch(ctx, upstream, params, since, relayed)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	//the clock of the last change sent for each key, so the catch up and
+	//the live events don't send the same change twice or an older one
+	//after a newer one
+	sent := make(map[string]vclock.VClock)
+	seen := since.copy()
+	//known is what the shard's metadata can cover once ev is out
+	send := func(ev watchEvent, shard int, known vclock.VClock) {
+		seen = seen.with(shard, known)
+		if last, ok := sent[ev.Key]; ok && descends(last, ev.Vector) {
+			return
+		}
+		sent[ev.Key] = ev.Vector
+		ev.Context = seen
+		data, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	}
+	//a plain watch only wants what happens from now on
+	if since != nil {
+		missed := catch_up(v, key, prefix, since)
+		for i, ev := range missed {
+			known := vclock.New()
+			if i == len(missed)-1 {
+				known = start
+			}
+			send(ev, v.selfID, known)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-mine.events:
+			if !ok {
+				fmt.Fprintf(w, "event: overflow\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			send(ev, v.selfID, ev.known)
+		case ev := <-relayed:
+			shard := shard_of(ev.Key, v.current)
+			send(ev, shard, ev.Context[shard])
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": ping\n\n")
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makes this node the only one of a single shard for one test
+func use_view(t *testing.T) {
+	viewMu.Lock()
+	old, oldView, oldSelf, oldIn := current, getView, selfID, inView
+	current = Shards{Shard: 1, Nodes: []string{"self"}}
+	getView = []NodeShards{{Shard: 0, Node: []string{"self"}}}
+	selfID, inView = 0, true
+	viewMu.Unlock()
+	t.Cleanup(func() {
+		viewMu.Lock()
+		current, getView, selfID, inView = old, oldView, oldSelf, oldIn
+		viewMu.Unlock()
+	})
+}
+
+func write_with(t *testing.T, key string, value string, dot Dot) {
+	t.Helper()
+	_, err := store.Update(key, func(item KVS, found bool) (KVS, bool) {
+		return put_item(item, found, key, value, nil, dot, time.Now()), true
+	})
+	dots.done(dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the events of a watch, until stop is called or the test ends
+func watch(t *testing.T, url string) (<-chan watchEvent, func()) {
+	t.Helper()
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	r, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan watchEvent, watchBuffer)
+	go func() {
+		defer response.Body.Close()
+		defer close(events)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			var ev watchEvent
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") && json.Unmarshal([]byte(line[6:]), &ev) == nil {
+				events <- ev
+			}
+		}
+	}()
+	return events, stop
+}
+
+// the keys of the events that come within a moment
+func keys_of(events <-chan watchEvent) []string {
+	keys := []string{}
+	timeout := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return keys
+			}
+			keys = append(keys, ev.Key)
+		case <-timeout:
+			return keys
+		}
+	}
+}
+
+// a write that finishes after one with a higher dot still reaches a
+// client that resumes from the metadata of the later one
+func TestWatchResumeAfterOutOfOrderWrites(t *testing.T) {
+	t.Setenv("ADDRESS", "self")
+	use_view(t)
+	use_store(t, new_store(memEngine{}, nil))
+	store.OnChange(watches.publish)
+	write_with(t, "old", "0", dots.next())
+
+	server := httptest.NewServer(http.HandlerFunc(watch_keys))
+	//after the streams are stopped
+	t.Cleanup(server.Close)
+	events, stop := watch(t, server.URL+"/kvs/watch?prefix=")
+	slow, fast := dots.next(), dots.next()
+	write_with(t, "a", "1", fast)
+	var last watchEvent
+	select {
+	case last = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no event for a")
+	}
+	//a plain watch doesn't get the keys that were there before
+	if last.Key != "a" {
+		t.Fatalf("got an event for %s first, want a", last.Key)
+	}
+	stop()
+	write_with(t, "b", "2", slow)
+
+	since, _ := json.Marshal(last.Context)
+	events, _ = watch(t, server.URL+"/kvs/watch?prefix=&since="+url.QueryEscape(string(since)))
+	got := keys_of(events)
+	found := false
+	for _, key := range got {
+		if key == "b" {
+			found = true
+		}
+		if key == "old" {
+			t.Errorf("resuming sent old again, the metadata covered it")
+		}
+	}
+	if !found {
+		t.Errorf("resuming sent %v, b is missing", got)
+	}
+}